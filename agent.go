@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the server no longer wants the build, eg because it was cancelled
+var errAgentGone = errors.New("build is gone from server")
+
+type labelsFlag []string
+
+func (l *labelsFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *labelsFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// agent runs builds for a ding server on this machine.
+// It asks the server for builds of repositories with labels it has, runs the clone and build steps locally,
+// and sends the output and result files back to the server.
+func agent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ding agent [flags] baseURL")
+		fs.PrintDefaults()
+	}
+	token := fs.String("token", os.Getenv("DING_AGENT_TOKEN"), "token to authenticate with, as configured in AgentTokens in the config file of the server; default from $DING_AGENT_TOKEN")
+	workDir := fs.String("workdir", "ding-agent", "directory to run builds in")
+	concurrency := fs.Int("concurrency", 1, "number of builds to run at the same time")
+	var labels labelsFlag
+	fs.Var(&labels, "label", "label to advertise, eg gpu=yes, can be repeated; os=<GOOS> and arch=<GOARCH> are always advertised")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 1 || *token == "" || *concurrency < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	labels = append(labelsFlag{"os=" + runtime.GOOS, "arch=" + runtime.GOARCH}, labels...)
+	dir, err := filepath.Abs(*workDir)
+	check(err, "making workdir absolute")
+	err = os.MkdirAll(dir, 0777)
+	check(err, "creating workdir")
+
+	c := &agentClient{strings.TrimRight(args[0], "/"), *token}
+	log.Printf("ding agent version %s, for %s, with labels %s\n", version, c.baseURL, labels.String())
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := c.nextJob(labels)
+				if err != nil {
+					log.Println("requesting job:", err)
+					time.Sleep(10 * time.Second)
+					continue
+				}
+				if job != nil {
+					runAgentJob(c, dir, *job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type agentClient struct {
+	baseURL string
+	token   string
+}
+
+// do makes a request to the server, returning an error for non-2xx responses.
+func (c *agentClient) do(method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, errAgentGone
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (c *agentClient) post(path string, query url.Values, body io.Reader) error {
+	resp, err := c.do("POST", path, query, body)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// nextJob waits for a build from the server, returning nil if none was available in time.
+func (c *agentClient) nextJob(labels []string) (*agentJob, error) {
+	buf, err := json.Marshal(map[string][]string{"labels": labels})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do("POST", "/agent/job", nil, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var job agentJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, fmt.Errorf("parsing job: %s", err)
+	}
+	return &job, nil
+}
+
+// agentRun is a build running on this agent.
+type agentRun struct {
+	client      *agentClient
+	job         agentJob
+	buildDir    string
+	checkoutDir string
+	prefix      string // of request paths for this build
+
+	outputLock sync.Mutex    // output is sent one request at a time, keeping it in order
+	gone       chan struct{} // closed when the server no longer wants the build
+	goneOnce   sync.Once
+}
+
+func runAgentJob(c *agentClient, workDir string, job agentJob) {
+	log.Printf("starting build %d for repo %s, branch %s\n", job.BuildID, job.RepoName, job.Branch)
+	buildDir := fmt.Sprintf("%s/%s/%d", workDir, job.RepoName, job.BuildID)
+	r := &agentRun{
+		client:      c,
+		job:         job,
+		buildDir:    buildDir,
+		checkoutDir: fmt.Sprintf("%s/checkout/%s", buildDir, job.CheckoutPath),
+		prefix:      fmt.Sprintf("/agent/build/%d/", job.BuildID),
+		gone:        make(chan struct{}),
+	}
+	defer os.RemoveAll(buildDir)
+
+	// let the server know we are still working on the build, and learn if it was cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if err := c.post(r.prefix+"ping", nil, nil); err == errAgentGone {
+				r.setGone()
+			} else if err != nil {
+				log.Printf("build %d: ping: %s\n", job.BuildID, err)
+			}
+		}
+	}()
+
+	err := r.run()
+	var result struct {
+		Error string `json:"error"`
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	buf, _ := json.Marshal(result)
+	if xerr := c.post(r.prefix+"finish", nil, bytes.NewReader(buf)); xerr != nil && xerr != errAgentGone {
+		log.Printf("build %d: finishing: %s\n", job.BuildID, xerr)
+	}
+	if err != nil {
+		log.Printf("build %d failed: %s\n", job.BuildID, err)
+	} else {
+		log.Printf("build %d finished\n", job.BuildID)
+	}
+}
+
+func (r *agentRun) setGone() {
+	r.goneOnce.Do(func() {
+		close(r.gone)
+	})
+}
+
+func (r *agentRun) run() error {
+	for _, dir := range []string{"checkout", "home", "scripts", "output"} {
+		if err := os.MkdirAll(r.buildDir+"/"+dir, 0777); err != nil {
+			return err
+		}
+	}
+
+	err := r.step("clone", r.clone)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range r.job.Steps {
+		s := s
+		err := r.step(s.Name, func() error {
+			script := fmt.Sprintf("%s/scripts/%s.sh", r.buildDir, s.Name)
+			if err := ioutil.WriteFile(script, []byte(s.Script), 0755); err != nil {
+				return err
+			}
+			var deadline time.Time
+			if r.job.BuildTimeout > 0 {
+				deadline = time.Now().Add(time.Duration(r.job.BuildTimeout) * time.Second)
+			}
+			return r.command(s.Name, r.checkoutDir, deadline, []string{"STEP=" + s.Name}, script)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.uploadResults()
+}
+
+// step runs fn as a step of the build, with its output sent to the server.
+func (r *agentRun) step(name string, fn func() error) error {
+	if err := r.client.post(r.prefix+"step", url.Values{"name": {name}}, nil); err != nil {
+		return err
+	}
+	err := fn()
+	var result struct {
+		Error string `json:"error"`
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	buf, xerr := json.Marshal(result)
+	if xerr == nil {
+		xerr = r.client.post(r.prefix+"stepdone", url.Values{"name": {name}}, bytes.NewReader(buf))
+	}
+	if err == nil {
+		err = xerr
+	}
+	return err
+}
+
+func (r *agentRun) clone() error {
+	job := r.job
+	var deadline time.Time
+	if job.CloneTimeout > 0 {
+		deadline = time.Now().Add(time.Duration(job.CloneTimeout) * time.Second)
+	}
+	checkout := "checkout/" + job.CheckoutPath
+
+	var err error
+	switch job.VCS {
+	case "git":
+		err = r.command("clone", r.buildDir, deadline, nil, "git", "clone", "--recursive", "--no-hardlinks", "--branch", job.Branch, job.Origin, checkout)
+	case "mercurial":
+		cmd := []string{"hg", "clone", "--branch", job.Branch}
+		if job.CommitHash != "" {
+			cmd = append(cmd, "--rev", job.CommitHash, "--updaterev", job.CommitHash)
+		}
+		cmd = append(cmd, job.Origin, checkout)
+		err = r.command("clone", r.buildDir, deadline, nil, cmd...)
+	case "command":
+		err = r.command("clone", r.buildDir, deadline, nil, "sh", "-c", job.Origin)
+	default:
+		err = fmt.Errorf("unexpected vcs %q", job.VCS)
+	}
+	if err != nil {
+		return err
+	}
+
+	commit := job.CommitHash
+	if commit == "" {
+		switch job.VCS {
+		case "command":
+			l := strings.Split(strings.TrimSpace(readFileLax(r.buildDir+"/output/clone.stdout")), "\n")
+			s := l[len(l)-1]
+			if !strings.HasPrefix(s, "commit:") {
+				return fmt.Errorf(`output of clone command should start with "commit:" followed by the commit id/hash`)
+			}
+			commit = s[len("commit:"):]
+		case "git", "mercurial":
+			args := []string{"git", "rev-parse", "HEAD"}
+			if job.VCS == "mercurial" {
+				args = []string{"hg", "id", "--id"}
+			}
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Dir = r.checkoutDir
+			buf, err := cmd.Output()
+			if err != nil {
+				return fmt.Errorf("finding commit hash: %s", err)
+			}
+			commit = strings.TrimSpace(string(buf))
+		}
+		if err := r.client.post(r.prefix+"commit", nil, strings.NewReader(commit)); err != nil {
+			return err
+		}
+	}
+
+	if job.VCS == "git" {
+		return r.command("clone", r.checkoutDir, deadline, nil, "git", "checkout", commit)
+	}
+	return nil
+}
+
+// command runs a command for a step, sending its output to the server, and keeping stdout in the output dir.
+// The command and its children are killed when the deadline is reached, or the server no longer wants the build.
+func (r *agentRun) command(step, workDir string, deadline time.Time, env []string, args ...string) error {
+	stdoutFile, err := os.OpenFile(r.buildDir+"/output/"+step+".stdout", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer stdoutFile.Close()
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = workDir
+	dirs := map[string]string{"BUILDDIR": r.buildDir, "HOME": r.buildDir + "/home"}
+	cmd.Env = mergeEnv(envMap(os.Environ()), envMap(r.job.Env), dirs, envMap(env))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var killed string
+	var killedLock sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		reason := ""
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			reason = "timeout"
+		case <-r.gone:
+			reason = "build gone from server"
+		}
+		killedLock.Lock()
+		killed = reason
+		killedLock.Unlock()
+		killProcessGroup(cmd.Process.Pid)
+	}()
+
+	var wg sync.WaitGroup
+	var sendErr error
+	var sendErrLock sync.Mutex
+	send := func(rd io.Reader, where string, keep io.Writer) {
+		defer wg.Done()
+		buf := make([]byte, 16*1024)
+		for {
+			n, err := rd.Read(buf)
+			if n > 0 {
+				if keep != nil {
+					keep.Write(buf[:n])
+				}
+				if xerr := r.output(step, where, buf[:n]); xerr != nil {
+					if xerr == errAgentGone {
+						r.setGone()
+					}
+					sendErrLock.Lock()
+					if sendErr == nil {
+						sendErr = xerr
+					}
+					sendErrLock.Unlock()
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go send(stdout, "stdout", stdoutFile)
+	go send(stderr, "stderr", nil)
+	wg.Wait()
+	err = cmd.Wait()
+	close(done)
+
+	killedLock.Lock()
+	defer killedLock.Unlock()
+	if killed != "" {
+		return fmt.Errorf("command killed: %s", killed)
+	}
+	if err == nil {
+		err = sendErr
+	}
+	return err
+}
+
+func (r *agentRun) output(step, where string, buf []byte) error {
+	r.outputLock.Lock()
+	defer r.outputLock.Unlock()
+	return r.client.post(r.prefix+"output", url.Values{"step": {step}, "where": {where}}, bytes.NewReader(buf))
+}
+
+// uploadResults sends the files from the "release:" lines of the build steps to the server.
+// Their paths must be relative to the checkout directory.
+func (r *agentRun) uploadResults() error {
+	for _, s := range r.job.Steps {
+		f, err := os.Open(r.buildDir + "/output/" + s.Name + ".stdout")
+		if err != nil {
+			return err
+		}
+		var paths []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			t := strings.Split(scanner.Text(), " ")
+			if t[0] == "release:" && len(t) == 7 {
+				paths = append(paths, t[6])
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, p := range paths {
+			if strings.HasPrefix(p, "/") {
+				return fmt.Errorf("release file %s: paths must be relative to the checkout directory for builds on agents", p)
+			}
+			if err := r.uploadFile(p); err != nil {
+				return fmt.Errorf("uploading release file %s: %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *agentRun) uploadFile(p string) error {
+	f, err := os.Open(r.checkoutDir + "/" + p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err := r.client.do("PUT", r.prefix+"file", url.Values{"path": {p}}, f)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
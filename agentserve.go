@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	agentPollWait = 30 * time.Second // how long a request for a job waits for a build before returning "no content"
+	agentTimeout  = 90 * time.Second // a claimed build fails if its agent has not been heard from for this long
+)
+
+// agentJob is a build handed to an agent, see "ding agent".
+type agentJob struct {
+	BuildID      int         `json:"build_id"`
+	RepoName     string      `json:"repo_name"`
+	VCS          string      `json:"vcs"`
+	Origin       string      `json:"origin"`
+	CheckoutPath string      `json:"checkout_path"`
+	Branch       string      `json:"branch"`
+	CommitHash   string      `json:"commit_hash"` // empty if the latest commit of the branch is to be built
+	Steps        []BuildStep `json:"steps"`
+	Env          []string    `json:"env"` // without BUILDDIR and HOME, the agent sets them for its own build directory
+	CloneTimeout int         `json:"clone_timeout"`
+	BuildTimeout int         `json:"build_timeout"`
+}
+
+// agentBuild is a build that runs on an agent, from the moment it waits for an agent until it has finished.
+type agentBuild struct {
+	job         agentJob
+	labels      []string
+	checkoutDir string          // where result files are stored
+	steps       chan *agentStep // steps as started by the agent
+	finished    chan struct{}   // closed when the agent has finished all steps and uploaded the result files
+	aborted     chan struct{}   // closed when the server gives up on the build, eg when it is cancelled
+
+	// protected by agentBuilds
+	agent     string // name of agent that claimed the build, empty while waiting for an agent
+	lastSeen  time.Time
+	current   *agentStep
+	commit    string
+	abortErr  error
+	finishing bool
+}
+
+// agentStep is a step running on an agent, its output is fed to track through pipes.
+type agentStep struct {
+	name             string
+	stdoutr, stderrr *io.PipeReader
+	stdoutw, stderrw *io.PipeWriter
+	wait             chan error
+}
+
+func (st *agentStep) done(err error) {
+	st.stdoutw.Close()
+	st.stderrw.Close()
+	select {
+	case st.wait <- err:
+	default:
+	}
+}
+
+func (st *agentStep) abort(err error) {
+	st.stdoutw.CloseWithError(err)
+	st.stderrw.CloseWithError(err)
+	select {
+	case st.wait <- err:
+	default:
+	}
+}
+
+var agentBuilds = struct {
+	sync.Mutex
+	pending []*agentBuild       // waiting for an agent, oldest first
+	active  map[int]*agentBuild // claimed by an agent, by build id
+	changed chan struct{}       // closed and replaced when a build is added to pending
+}{active: map[int]*agentBuild{}, changed: make(chan struct{})}
+
+// abort makes the build and the agent running it give up. Must be called with agentBuilds locked.
+func (ab *agentBuild) abort(err error) {
+	if ab.abortErr != nil {
+		return
+	}
+	ab.abortErr = err
+	if ab.current != nil {
+		ab.current.abort(err)
+	}
+	close(ab.aborted)
+}
+
+func agentLabelsOrEmpty(labels []string) []string {
+	if labels == nil {
+		return []string{}
+	}
+	return labels
+}
+
+func agentLabelsMatch(want, have []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if w == h {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// agentEnv returns the build environment without the variables pointing to directories on this machine.
+func agentEnv(env []string) []string {
+	r := []string{}
+	for _, s := range env {
+		if strings.HasPrefix(s, "BUILDDIR=") || strings.HasPrefix(s, "HOME=") || strings.HasPrefix(s, "CACHEDIR=") {
+			continue
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
+// _doAgentBuild hands the build to an agent with the labels of the repository, and tracks the output of the clone and build steps it runs.
+// When it returns, the result files have been uploaded to the checkout directory and the build can be finished as a local build.
+func _doAgentBuild(repo Repo, build *Build, buildDir string, env []string, stepNames []string) {
+	job := agentJob{
+		BuildID:      build.ID,
+		RepoName:     repo.Name,
+		VCS:          repo.VCS,
+		Origin:       repo.Origin,
+		CheckoutPath: repo.CheckoutPath,
+		Branch:       build.Branch,
+		CommitHash:   build.CommitHash,
+		Env:          agentEnv(env),
+		CloneTimeout: repo.CloneTimeout,
+		BuildTimeout: repo.BuildTimeout,
+	}
+	for _, name := range stepNames {
+		job.Steps = append(job.Steps, BuildStep{name, readFile(fmt.Sprintf("%s/scripts/%s.sh", buildDir, name))})
+	}
+	ab := &agentBuild{
+		job:         job,
+		labels:      repo.AgentLabels,
+		checkoutDir: fmt.Sprintf("%s/checkout/%s", buildDir, repo.CheckoutPath),
+		steps:       make(chan *agentStep),
+		finished:    make(chan struct{}),
+		aborted:     make(chan struct{}),
+	}
+
+	agentBuilds.Lock()
+	agentBuilds.pending = append(agentBuilds.pending, ab)
+	close(agentBuilds.changed)
+	agentBuilds.changed = make(chan struct{})
+	agentBuilds.Unlock()
+
+	defer func() {
+		agentBuilds.Lock()
+		defer agentBuilds.Unlock()
+		for i, x := range agentBuilds.pending {
+			if x == ab {
+				agentBuilds.pending = append(agentBuilds.pending[:i:i], agentBuilds.pending[i+1:]...)
+				break
+			}
+		}
+		delete(agentBuilds.active, build.ID)
+		// an agent still working on the build will get "gone" on its next request
+		ab.abort(fmt.Errorf("build finished"))
+	}()
+
+	// give up on cancelled builds and on agents that went away
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			agentBuilds.Lock()
+			if buildCancelled(build.ID) {
+				ab.abort(fmt.Errorf("%s", cancelledMsg))
+			} else if ab.agent != "" && time.Since(ab.lastSeen) > agentTimeout {
+				ab.abort(fmt.Errorf("agent %s stopped responding", ab.agent))
+			}
+			agentBuilds.Unlock()
+		}
+	}()
+
+	abortError := func() {
+		agentBuilds.Lock()
+		err := ab.abortErr
+		agentBuilds.Unlock()
+		userError(err.Error())
+	}
+
+	for i, name := range append([]string{"clone"}, stepNames...) {
+		var st *agentStep
+		select {
+		case st = <-ab.steps:
+		case <-ab.aborted:
+			abortError()
+		}
+		if st.name != name {
+			agentBuilds.Lock()
+			ab.abort(fmt.Errorf("agent started step %q, expected %q", st.name, name))
+			agentBuilds.Unlock()
+			abortError()
+		}
+		transact(func(tx *sql.Tx) {
+			_, err := tx.Exec("update build set status=$1 where id=$2", name, build.ID)
+			sherpaCheck(err, "updating build status in database")
+			events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
+		})
+		err := track(build.ID, name, buildDir, st.stdoutr, st.stderrr, st.wait)
+		if i == 0 {
+			sherpaUserCheck(err, "cloning repository on agent")
+		} else {
+			sherpaUserCheck(err, "running step "+name)
+		}
+
+		if i == 0 && build.CommitHash == "" {
+			agentBuilds.Lock()
+			build.CommitHash = ab.commit
+			agentBuilds.Unlock()
+			if build.CommitHash == "" {
+				userError("Agent did not report the commit hash.")
+			}
+			transact(func(tx *sql.Tx) {
+				err := tx.QueryRow(`update build set commit_hash=$1 where id=$2 returning id`, build.CommitHash, build.ID).Scan(&build.ID)
+				sherpaCheck(err, "updating commit hash in database")
+				events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
+			})
+		}
+	}
+
+	select {
+	case <-ab.finished:
+	case <-ab.aborted:
+		abortError()
+	}
+}
+
+// bearerToken returns the token from the "Authorization: Bearer <token>" header of the request, or the empty string.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return auth[len(prefix):]
+}
+
+// agentName returns the name of the agent authenticated by the bearer token of the request, or the empty string.
+func agentName(r *http.Request) string {
+	token := bearerToken(r)
+	if token == "" {
+		return ""
+	}
+	for name, t := range config.AgentTokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// serveAgent handles requests from agents: for a job, and for the builds they claimed.
+//
+//	POST /agent/job, with JSON body {"labels": [...]}, returns an agentJob, or 204 if none is available.
+//	POST /agent/build/<id>/ping
+//	POST /agent/build/<id>/step?name=<step>
+//	POST /agent/build/<id>/output?step=<step>&where=<stdout|stderr>, with output as body
+//	POST /agent/build/<id>/stepdone?name=<step>, with JSON body {"error": "..."}
+//	POST /agent/build/<id>/commit, with commit hash as body
+//	PUT /agent/build/<id>/file?path=<path>, with the contents of a result file relative to the checkout directory
+//	POST /agent/build/<id>/finish, with JSON body {"error": "..."}, the error is empty if the build succeeded
+//
+// Requests for builds that are no longer running on the agent, eg because they were cancelled, get status 410.
+func serveAgent(w http.ResponseWriter, r *http.Request) {
+	if len(config.AgentTokens) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name := agentName(r)
+	if name == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/agent/job" {
+		serveAgentJob(w, r, name)
+		return
+	}
+
+	t := strings.Split(strings.TrimPrefix(r.URL.Path, "/agent/build/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/agent/build/") || len(t) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	buildID, err := strconv.Atoi(t[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	agentBuilds.Lock()
+	ab, ok := agentBuilds.active[buildID]
+	if !ok || ab.agent != name || ab.abortErr != nil {
+		agentBuilds.Unlock()
+		http.Error(w, "gone", http.StatusGone)
+		return
+	}
+	ab.lastSeen = time.Now()
+	agentBuilds.Unlock()
+
+	switch t[1] {
+	case "ping":
+		w.WriteHeader(http.StatusNoContent)
+
+	case "step":
+		stepName := r.FormValue("name")
+		st := &agentStep{name: stepName, wait: make(chan error, 1)}
+		st.stdoutr, st.stdoutw = io.Pipe()
+		st.stderrr, st.stderrw = io.Pipe()
+		agentBuilds.Lock()
+		if ab.current != nil {
+			agentBuilds.Unlock()
+			http.Error(w, "step already running", http.StatusBadRequest)
+			return
+		}
+		ab.current = st
+		agentBuilds.Unlock()
+		select {
+		case ab.steps <- st:
+			w.WriteHeader(http.StatusNoContent)
+		case <-ab.aborted:
+			http.Error(w, "gone", http.StatusGone)
+		}
+
+	case "output":
+		agentBuilds.Lock()
+		st := ab.current
+		agentBuilds.Unlock()
+		if st == nil || st.name != r.FormValue("step") {
+			http.Error(w, "step not running", http.StatusBadRequest)
+			return
+		}
+		var pw *io.PipeWriter
+		switch r.FormValue("where") {
+		case "stdout":
+			pw = st.stdoutw
+		case "stderr":
+			pw = st.stderrw
+		default:
+			http.Error(w, "bad parameter where", http.StatusBadRequest)
+			return
+		}
+		if _, err := io.Copy(pw, r.Body); err != nil {
+			http.Error(w, "gone", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "stepdone":
+		var result struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		agentBuilds.Lock()
+		st := ab.current
+		ab.current = nil
+		agentBuilds.Unlock()
+		if st == nil || st.name != r.FormValue("name") {
+			http.Error(w, "step not running", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if result.Error != "" {
+			err = fmt.Errorf("%s", result.Error)
+		}
+		st.done(err)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "commit":
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, "reading commit", http.StatusBadRequest)
+			return
+		}
+		agentBuilds.Lock()
+		ab.commit = strings.TrimSpace(string(buf))
+		agentBuilds.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	case "file":
+		p := path.Clean(r.FormValue("path"))
+		if p == "." || p == ".." || strings.HasPrefix(p, "/") || strings.HasPrefix(p, "../") {
+			http.Error(w, "bad path", http.StatusBadRequest)
+			return
+		}
+		dst := ab.checkoutDir + "/" + p
+		if err := agentWriteFile(dst, r.Body); err != nil {
+			log.Printf("agent %s: storing result file for build %d: %s\n", name, buildID, err)
+			http.Error(w, "error storing file", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "finish":
+		var result struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		agentBuilds.Lock()
+		if result.Error != "" {
+			ab.abort(fmt.Errorf("%s", result.Error))
+		} else if !ab.finishing {
+			ab.finishing = true
+			close(ab.finished)
+		}
+		agentBuilds.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func agentWriteFile(dst string, r io.Reader) error {
+	if err := os.MkdirAll(path.Dir(dst), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if xerr := f.Close(); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+// serveAgentJob waits for a build the agent can run, and hands it out.
+func serveAgentJob(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		Labels []string `json:"labels"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad json", http.StatusBadRequest)
+		return
+	}
+
+	timeout := time.NewTimer(agentPollWait)
+	defer timeout.Stop()
+	for {
+		agentBuilds.Lock()
+		for i, ab := range agentBuilds.pending {
+			if !agentLabelsMatch(ab.labels, req.Labels) {
+				continue
+			}
+			agentBuilds.pending = append(agentBuilds.pending[:i:i], agentBuilds.pending[i+1:]...)
+			ab.agent = name
+			ab.lastSeen = time.Now()
+			agentBuilds.active[ab.job.BuildID] = ab
+			agentBuilds.Unlock()
+
+			log.Printf("agent %s: starting build %d for repo %s\n", name, ab.job.BuildID, ab.job.RepoName)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(ab.job); err != nil {
+				log.Printf("agent %s: writing job: %s\n", name, err)
+			}
+			return
+		}
+		changed := agentBuilds.changed
+		agentBuilds.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
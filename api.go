@@ -1,8 +1,9 @@
 package main
 
 import (
-	"compress/gzip"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,13 +17,6 @@ import (
 	"bitbucket.org/mjl/sherpa"
 )
 
-var (
-	stepNames = []string{
-		"clone",
-		"build",
-	}
-)
-
 // The Ding API lets you compile git branches, build binaries, run tests, and publish binaries.
 type Ding struct {
 	SSE SSE `sherpa:"Server-Sent Events"`
@@ -129,6 +123,9 @@ func _build(tx *sql.Tx, repoName string, id int) (b Build) {
 	q := `select row_to_json(bwr.*) from build_with_result bwr where id = $1`
 	sherpaCheckRow(tx.QueryRow(q, id), &b, "fetching build")
 	fillBuild(repoName, &b)
+	if b.ParentID == nil {
+		b.Children = _childBuilds(tx, repoName, b.ID)
+	}
 	return
 }
 
@@ -140,29 +137,69 @@ func (Ding) CreateBuild(repoName, branch, commit string) Build {
 	}
 
 	repo, build, buildDir := _prepareBuild(repoName, branch, commit)
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				if serr, ok := err.(*sherpa.Error); ok {
-					if serr.Code != "userError" {
-						log.Println("background build failed:", serr.Message)
-					}
-				}
-			}
-		}()
-		doBuild(repo, build, buildDir)
-	}()
+	goBuild(repo, build, buildDir)
 	return build
 }
 
+// CancelBuild cancels a build that is queued or running.
+// A queued build is removed from the queue. For a running build, the running command and all its child processes are killed.
+// Cancelling a build of a build matrix cancels the builds of all its variants.
+// The build ends with status `cancelled`.
+func (Ding) CancelBuild(repoName string, buildID int) {
+	var build Build
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		build = _build(tx, repo.Name, buildID)
+		if build.RepoID != repo.ID {
+			userError("Build does not belong to repository.")
+		}
+		if build.Finish != nil {
+			userError("Build has already finished.")
+		}
+	})
+
+	if len(build.Children) == 0 {
+		if !cancelBuild(repoName, buildID) {
+			userError("Build is not queued or running.")
+		}
+		return
+	}
+	if !cancelActiveBuild(buildID) {
+		userError("Build is not queued or running.")
+	}
+	for _, child := range build.Children {
+		if child.Finish == nil {
+			cancelBuild(repoName, child.ID)
+		}
+	}
+}
+
 func toJSON(v interface{}) string {
 	buf, err := json.Marshal(v)
 	sherpaCheck(err, "encoding to json")
 	return string(buf)
 }
 
-// CreateRelease release a build.
-func (Ding) CreateRelease(repoName string, buildID int) (build Build) {
+// CreateRelease release a build, in a channel like `stable` (the default if empty), `beta` or `nightly`.
+func (Ding) CreateRelease(repoName string, buildID int, channel string) (build Build) {
+	channel = releaseChannel(channel)
+
+	// files stored before a failure, or before the transaction fails to commit, must not be left behind.
+	// a later attempt would find them as released files.
+	var storedDir string
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if storedDir != "" {
+			if err := releaseStore.RemoveAll(storedDir); err != nil {
+				log.Printf("removing files of failed release %s: %s\n", storedDir, err)
+			}
+		}
+		panic(e)
+	}()
+
 	transact(func(tx *sql.Tx) {
 		repo := _repo(tx, repoName)
 
@@ -173,24 +210,32 @@ func (Ding) CreateRelease(repoName string, buildID int) (build Build) {
 		if build.Status != "success" {
 			panic(&sherpa.Error{Code: "userError", Message: "Build was not successful"})
 		}
+		if len(build.Children) > 0 {
+			userError("Build has a build matrix, release the builds of its variants instead.")
+		}
 
 		br := _buildResult(repo.Name, build)
 		steps := toJSON(br.Steps)
+		changelog := toJSON(_changelog(tx, repo, build))
 
-		qrel := `insert into release (build_id, time, build_script, steps) values ($1, now(), $2, $3::json) returning build_id`
-		err := tx.QueryRow(qrel, build.ID, br.BuildScript, steps).Scan(&build.ID)
+		qrel := `insert into release (build_id, time, build_script, steps, changelog) values ($1, now(), $2, $3::json, $4::json) returning build_id`
+		err := tx.QueryRow(qrel, build.ID, br.BuildScript, steps, changelog).Scan(&build.ID)
 		sherpaCheck(err, "inserting release into database")
 
-		qup := `update build set released=now() where id=$1 returning id`
-		err = tx.QueryRow(qup, build.ID).Scan(&build.ID)
+		qup := `update build set released=now(), release_channel=$2 where id=$1 returning id`
+		err = tx.QueryRow(qup, build.ID, channel).Scan(&build.ID)
 		sherpaCheck(err, "marking build as released in database")
 
-		var filenames []string
-		q := `select coalesce(json_agg(result.filename), '[]') from result where build_id=$1`
-		sherpaCheckRow(tx.QueryRow(q, build.ID), &filenames, "fetching build results from database")
+		var results []Result
+		q := `select coalesce(json_agg(result.*), '[]') from result where build_id=$1`
+		sherpaCheckRow(tx.QueryRow(q, build.ID), &results, "fetching build results from database")
 		checkoutDir := fmt.Sprintf("data/build/%s/%d/checkout/%s", repo.Name, build.ID, repo.CheckoutPath)
-		for _, filename := range filenames {
-			fileCopy(checkoutDir+"/"+filename, fmt.Sprintf("data/release/%s/%d/%s.gz", repo.Name, build.ID, path.Base(filename)))
+		storedDir = fmt.Sprintf("%s/%d", repo.Name, build.ID)
+		for _, result := range results {
+			src := checkoutDir + "/" + result.Filename
+			key := fmt.Sprintf("%s/%d/%s", repo.Name, build.ID, path.Base(result.Filename))
+			fileCopy(src, key, result.Sha256)
+			signRelease(src, key+".minisig")
 		}
 
 		events <- EventBuild{repo.Name, _build(tx, repo.Name, buildID)}
@@ -198,31 +243,22 @@ func (Ding) CreateRelease(repoName string, buildID int) (build Build) {
 	return
 }
 
-func fileCopy(src, dst string) {
-	err := os.MkdirAll(path.Dir(dst), 0777)
-	sherpaCheck(err, "making directory for copying result file")
+// fileCopy stores src as the released file key. If sum is not empty, the SHA-256 of the stored data must match.
+func fileCopy(src, key, sum string) {
 	sf, err := os.Open(src)
 	sherpaCheck(err, "open result file")
 	defer sf.Close()
-	df, err := os.Create(dst)
-	sherpaCheck(err, "creating destination result file")
-	gzw := gzip.NewWriter(df)
-	defer func() {
-		xerr := func(err1, err2 error) error {
-			if err1 == nil {
-				return err2
-			}
-			return err1
+	fi, err := sf.Stat()
+	sherpaCheck(err, "stat result file")
+	h := sha256.New()
+	err = releaseStore.Store(key, io.TeeReader(sf, h), fi.Size())
+	sherpaCheck(err, "installing result file")
+	if sum != "" && hex.EncodeToString(h.Sum(nil)) != sum {
+		if err := releaseStore.Remove(key); err != nil {
+			log.Printf("removing released file %s with bad checksum: %s\n", key, err)
 		}
-		err = xerr(err, gzw.Close())
-		err = xerr(err, df.Close())
-		if err != nil {
-			os.Remove(dst)
-			sherpaCheck(err, "installing result file")
-		}
-	}()
-	_, err = io.Copy(gzw, sf)
-	sherpaCheck(err, "copying result file to destination")
+		sherpaCheck(fmt.Errorf("checksum of %s does not match checksum recorded at build", path.Base(src)), "installing result file")
+	}
 }
 
 // RepoBuilds returns all repositories and their latest build per branch (always for master, default & develop, for other branches only if the latest build was less than 4 weeks ago).
@@ -234,7 +270,7 @@ func (Ding) RepoBuilds() (rb []RepoBuilds) {
 			where id in (
 				select max(id) as id
 				from build
-				where branch in ('master', 'default', 'develop') or start > now() - interval '4 weeks'
+				where parent_id is null and (branch in ('master', 'default', 'develop') or start > now() - interval '4 weeks')
 				group by repo_id, branch
 			)
 		)
@@ -252,6 +288,7 @@ func (Ding) RepoBuilds() (rb []RepoBuilds) {
 			fillBuild(e.Repo.Name, &b)
 			e.Builds[i] = b
 		}
+		fillChildren(database, e.Repo.Name, e.Builds)
 	}
 	return
 }
@@ -265,13 +302,15 @@ func (Ding) Repo(repoName string) (repo Repo) {
 }
 
 // Builds returns builds for a repo.
+// Builds for variants of a build matrix are returned as children of the build that started them.
 func (Ding) Builds(repoName string) (builds []Build) {
-	q := `select coalesce(json_agg(bwr.* order by start desc), '[]') from build_with_result bwr join repo on bwr.repo_id = repo.id where repo.name=$1`
+	q := `select coalesce(json_agg(bwr.* order by start desc), '[]') from build_with_result bwr join repo on bwr.repo_id = repo.id where repo.name=$1 and bwr.parent_id is null`
 	sherpaCheckRow(database.QueryRow(q, repoName), &builds, "fetching builds")
 	for i, b := range builds {
 		fillBuild(repoName, &b)
 		builds[i] = b
 	}
+	fillChildren(database, repoName, builds)
 	return
 }
 
@@ -282,16 +321,44 @@ func _checkRepo(repo Repo) {
 	if strings.HasPrefix(repo.CheckoutPath, "/") || strings.HasSuffix(repo.CheckoutPath, "/") {
 		userError("Checkout path cannot start or end with a slash.")
 	}
+	if repo.BuildConcurrency < 1 {
+		userError("Build concurrency must be at least 1.")
+	}
+	if repo.CloneTimeout < 0 || repo.BuildTimeout < 0 {
+		userError("Timeouts cannot be negative.")
+	}
+	if repo.IsolateNetwork && (!config.IsolateBuilds.Enabled || !sandboxSupported) {
+		// builds would fail when setting up the network namespace
+		userError("Network isolation requires isolated builds on Linux, see isolateBuilds in the config file.")
+	}
+	_checkSteps(repo.Steps)
+	_checkMatrix(repo.Matrix)
+	_checkTriggers(repo)
+	_checkPoll(repo)
+	for _, l := range repo.AgentLabels {
+		if l == "" {
+			userError("Agent label cannot be empty.")
+		}
+	}
+	l := repo.Limits
+	if l.AddressSpace < 0 || l.Processes < 0 || l.FileSize < 0 || l.OpenFiles < 0 || l.CPUSeconds < 0 {
+		userError("Limits cannot be negative.")
+	}
 }
 
 // CreateRepo creates a new repository.
+// If `build_concurrency` is 0, it is set to 1.
 func (Ding) CreateRepo(repo Repo) (r Repo) {
+	if repo.BuildConcurrency == 0 {
+		repo.BuildConcurrency = 1
+	}
 	_checkRepo(repo)
 
 	transact(func(tx *sql.Tx) {
-		q := `insert into repo (name, vcs, origin, checkout_path, build_script) values ($1, $2, $3, $4, '') returning id`
+		q := `insert into repo (name, vcs, origin, checkout_path, build_script, build_concurrency, clone_timeout, build_timeout, limits, sandbox, isolate_network, steps, matrix, cache, triggers, poll_interval, poll_include, poll_exclude, agent_labels) values ($1, $2, $3, $4, '', $5, $6, $7, $8::jsonb, $9, $10, $11::jsonb, $12::jsonb, $13, $14::jsonb, $15, $16::jsonb, $17::jsonb, $18::jsonb) returning id`
 		var id int64
-		sherpaCheckRow(tx.QueryRow(q, repo.Name, repo.VCS, repo.Origin, repo.CheckoutPath), &id, "inserting repository in database")
+		sherpaCheckRow(tx.QueryRow(q, repo.Name, repo.VCS, repo.Origin, repo.CheckoutPath, repo.BuildConcurrency, repo.CloneTimeout, repo.BuildTimeout, toJSON(repo.Limits), repo.Sandbox, repo.IsolateNetwork, toJSON(stepsOrEmpty(repo.Steps)), toJSON(matrixOrEmpty(repo.Matrix)), repo.Cache, toJSON(triggersOrEmpty(repo.Triggers)), repo.PollInterval, toJSON(pollPatternsOrEmpty(repo.PollInclude)), toJSON(pollPatternsOrEmpty(repo.PollExclude)), toJSON(agentLabelsOrEmpty(repo.AgentLabels))), &id, "inserting repository in database")
+		_checkTriggerCycles(tx)
 		r = _repo(tx, repo.Name)
 
 		events <- EventRepo{r}
@@ -304,8 +371,9 @@ func (Ding) SaveRepo(repo Repo) (r Repo) {
 	_checkRepo(repo)
 
 	transact(func(tx *sql.Tx) {
-		q := `update repo set name=$1, vcs=$2, origin=$3, checkout_path=$4, build_script=$5 where id=$6 returning row_to_json(repo.*)`
-		sherpaCheckRow(tx.QueryRow(q, repo.Name, repo.VCS, repo.Origin, repo.CheckoutPath, repo.BuildScript, repo.ID), &r, "updating repo in database")
+		q := `update repo set name=$1, vcs=$2, origin=$3, checkout_path=$4, build_script=$5, build_concurrency=$6, clone_timeout=$7, build_timeout=$8, limits=$9::jsonb, sandbox=$10, isolate_network=$11, steps=$12::jsonb, matrix=$13::jsonb, cache=$14, triggers=$15::jsonb, poll_interval=$16, poll_include=$17::jsonb, poll_exclude=$18::jsonb, agent_labels=$19::jsonb, poll_baseline=case when $16=0 or poll_interval=0 then null else poll_baseline end where id=$20 returning row_to_json(repo.*)`
+		sherpaCheckRow(tx.QueryRow(q, repo.Name, repo.VCS, repo.Origin, repo.CheckoutPath, repo.BuildScript, repo.BuildConcurrency, repo.CloneTimeout, repo.BuildTimeout, toJSON(repo.Limits), repo.Sandbox, repo.IsolateNetwork, toJSON(stepsOrEmpty(repo.Steps)), toJSON(matrixOrEmpty(repo.Matrix)), repo.Cache, toJSON(triggersOrEmpty(repo.Triggers)), repo.PollInterval, toJSON(pollPatternsOrEmpty(repo.PollInclude)), toJSON(pollPatternsOrEmpty(repo.PollExclude)), toJSON(agentLabelsOrEmpty(repo.AgentLabels)), repo.ID), &r, "updating repo in database")
+		_checkTriggerCycles(tx)
 		r = _repo(tx, repo.Name)
 
 		events <- EventRepo{r}
@@ -322,15 +390,23 @@ func (Ding) RemoveRepo(repoName string) {
 		_, err = tx.Exec(`delete from build where repo_id in (select id from repo where name=$1)`, repoName)
 		sherpaCheck(err, "removing builds from database")
 
+		_, err = tx.Exec(`delete from repo_env where repo_id in (select id from repo where name=$1)`, repoName)
+		sherpaCheck(err, "removing environment variables from database")
+
+		_, err = tx.Exec(`delete from schedule where repo_id in (select id from repo where name=$1)`, repoName)
+		sherpaCheck(err, "removing schedules from database")
+
 		var id int
 		sherpaCheckRow(tx.QueryRow(`delete from repo where name=$1 returning id`, repoName), &id, "removing repo from database")
 	})
 	events <- EventRemoveRepo{repoName}
 
 	_removeDir(repoName, -1)
+	_removeCache(repoName)
+	removeMirror(repoName)
 
-	err := os.RemoveAll(fmt.Sprintf("data/release/%s", repoName))
-	sherpaCheck(err, "removing release directory")
+	err := releaseStore.RemoveAll(repoName)
+	sherpaCheck(err, "removing released files")
 }
 
 func parseInt(s string) int64 {
@@ -344,7 +420,11 @@ func parseInt(s string) int64 {
 
 func _buildResult(repoName string, build Build) (br BuildResult) {
 	buildDir := fmt.Sprintf("data/build/%s/%d/", repoName, build.ID)
-	br.BuildScript = readFile(buildDir + "scripts/build.sh")
+	br.BuildScript = readFileLax(buildDir + "scripts/build.sh")
+	br.Scripts = []BuildStep{}
+	for _, name := range buildStepNames(buildDir) {
+		br.Scripts = append(br.Scripts, BuildStep{name, readFileLax(buildDir + "scripts/" + name + ".sh")})
+	}
 	br.Steps = []Step{}
 
 	if build.Status == "new" {
@@ -352,13 +432,23 @@ func _buildResult(repoName string, build Build) (br BuildResult) {
 	}
 
 	outputDir := buildDir + "output/"
+	stepNames := append([]string{"clone"}, buildStepNames(buildDir)...)
 	for _, stepName := range stepNames {
+		if build.Status == "cancelled" || build.Status == "matrix" || build.Status == "failed" || len(build.Children) > 0 {
+			// step did not run, or the build only started builds for variants
+			if _, err := os.Stat(outputDir + stepName + ".output"); err != nil {
+				break
+			}
+		}
+		nsec := parseInt(readFileLax(outputDir + stepName + ".nsec"))
 		br.Steps = append(br.Steps, Step{
 			Name:   stepName,
 			Stdout: readFileLax(outputDir + stepName + ".stdout"),
 			Stderr: readFileLax(outputDir + stepName + ".stderr"),
 			Output: readFileLax(outputDir + stepName + ".output"),
-			Nsec:   parseInt(readFileLax(outputDir + stepName + ".nsec")),
+			Nsec:   nsec,
+
+			Sections: parseSections(readFileLax(outputDir+stepName+".sections"), nsec),
 		})
 		if stepName == build.Status {
 			break
@@ -378,7 +468,7 @@ func (Ding) BuildResult(repoName string, buildID int) (br BuildResult) {
 	return
 }
 
-// Release fetches the build config and results for a release.
+// Release fetches the build config, results and changelog for a release.
 func (Ding) Release(repoName string, buildID int) (br BuildResult) {
 	transact(func(tx *sql.Tx) {
 		build := _build(tx, repoName, buildID)
@@ -401,6 +491,11 @@ func (Ding) RemoveBuild(buildID int) {
 		if build.Released != nil {
 			panic(&sherpa.Error{Code: "userError", Message: "Build has been released, cannot be removed"})
 		}
+		for _, child := range build.Children {
+			if child.Released != nil {
+				userError(fmt.Sprintf("Variant %s of build has been released, cannot be removed.", child.Variant))
+			}
+		}
 
 		_removeBuild(tx, repoName, buildID)
 	})
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +15,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bitbucket.org/mjl/sherpa"
@@ -20,31 +25,34 @@ import (
 func _prepareBuild(repoName, branch, commit string) (repo Repo, build Build, buildDir string) {
 	transact(func(tx *sql.Tx) {
 		repo = _repo(tx, repoName)
+		build, buildDir = _insertBuild(tx, repo, branch, commit, nil, "")
+	})
+	events <- EventBuild{repo.Name, build}
+	return
+}
 
-		q := `insert into build (repo_id, branch, commit_hash, status, start) values ($1, $2, $3, $4, NOW()) returning id`
-		sherpaCheckRow(tx.QueryRow(q, repo.ID, branch, commit, "new"), &build.ID, "inserting new build into database")
+// _insertBuild adds a new build to the database and creates its build directory.
+// For a variant of a build matrix, parentID and variant are set.
+func _insertBuild(tx *sql.Tx, repo Repo, branch, commit string, parentID *int, variant string) (build Build, buildDir string) {
+	q := `insert into build (repo_id, branch, commit_hash, status, start, parent_id, variant) values ($1, $2, $3, $4, NOW(), $5, $6) returning id`
+	sherpaCheckRow(tx.QueryRow(q, repo.ID, branch, commit, "new", parentID, variant), &build.ID, "inserting new build into database")
 
-		buildDir = fmt.Sprintf("%s/data/build/%s/%d", dingWorkDir, repo.Name, build.ID)
-		err := os.MkdirAll(buildDir, 0777)
-		sherpaCheck(err, "creating build dir")
+	buildDir = fmt.Sprintf("%s/data/build/%s/%d", dingWorkDir, repo.Name, build.ID)
+	err := os.MkdirAll(buildDir, 0777)
+	sherpaCheck(err, "creating build dir")
 
-		err = os.MkdirAll(buildDir+"/scripts", 0777)
-		sherpaCheck(err, "creating scripts dir")
-		err = os.MkdirAll(buildDir+"/home", 0777)
-		sherpaCheck(err, "creating home dir")
+	err = os.MkdirAll(buildDir+"/scripts", 0777)
+	sherpaCheck(err, "creating scripts dir")
+	err = os.MkdirAll(buildDir+"/home", 0777)
+	sherpaCheck(err, "creating home dir")
 
-		buildSh := buildDir + "/scripts/build.sh"
-		writeFile(buildSh, repo.BuildScript)
-		err = os.Chmod(buildSh, os.FileMode(0755))
-		sherpaCheck(err, "chmod")
+	writeSteps(buildDir, repoSteps(repo))
 
-		outputDir := buildDir + "/output"
-		err = os.MkdirAll(outputDir, 0777)
-		sherpaCheck(err, "creating output dir")
+	outputDir := buildDir + "/output"
+	err = os.MkdirAll(outputDir, 0777)
+	sherpaCheck(err, "creating output dir")
 
-		build = _build(tx, repo.Name, build.ID)
-	})
-	events <- EventBuild{repo.Name, build}
+	build = _build(tx, repo.Name, build.ID)
 	return
 }
 
@@ -77,44 +85,66 @@ func prepareBuild(repoName, branch, commit string) (repo Repo, build Build, buil
 	return repo, build, buildDir, nil
 }
 
+// goBuild runs the build in the background.
+func goBuild(repo Repo, build Build, buildDir string) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				if serr, ok := err.(*sherpa.Error); ok {
+					if serr.Code != "userError" {
+						log.Println("background build failed:", serr.Message)
+					}
+				}
+			}
+		}()
+		doBuild(repo, build, buildDir)
+	}()
+}
+
 func doBuild(repo Repo, build Build, buildDir string) {
-	job := job{
-		repo.Name,
-		make(chan struct{}),
+	if build.ParentID == nil && len(repo.Matrix) > 0 {
+		doMatrixBuild(repo, build, buildDir)
+		return
 	}
-	newJobs <- job
-	<-job.rc
-	defer func() {
-		finishedJobs <- job.repoName
-	}()
-	_doBuild(repo, build, buildDir)
+	job := enqueueJob(repo, build)
+	runJob(job, repo, build, buildDir)
 }
 
 func _doBuild(repo Repo, build Build, buildDir string) {
 	defer func() {
+		r := recover()
+		cancelled := r != nil && buildCancelled(build.ID)
+
 		build.DiskUsage = buildDiskUsage(buildDir)
 		transact(func(tx *sql.Tx) {
 			q := `update build set finish=NOW(), disk_usage=$1 where id=$2 and finish is null`
 			_, err := tx.Exec(q, build.DiskUsage, build.ID)
 			sherpaCheck(err, "marking build as finished in database")
+			if cancelled {
+				_, err = tx.Exec(`update build set status='cancelled', error_message=$1 where id=$2`, cancelledMsg, build.ID)
+				sherpaCheck(err, "marking build as cancelled in database")
+			}
 			events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
 		})
 
 		_cleanupBuilds(repo.Name, build.Branch)
 
-		r := recover()
-		if r != nil {
+		if r != nil && !cancelled {
 			if serr, ok := r.(*sherpa.Error); ok && serr.Code == "userError" {
 				transact(func(tx *sql.Tx) {
-					err := tx.QueryRow(`update build set error_message=$1 where id=$2 returning id`, serr.Message, build.ID).Scan(&build.ID)
+					err := tx.QueryRow(`update build set error_message=$1 where id=$2 returning id`, buildMasker(build.ID).mask(serr.Message), build.ID).Scan(&build.ID)
 					sherpaCheck(err, "updating error message in database")
 					events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
 				})
 			}
 		}
 
+		if cancelled {
+			return
+		}
+
 		var prevStatus string
-		err := database.QueryRow("select status from build join repo on build.repo_id = repo.id and repo.name = $1 and build.branch = $2 order by build.id desc offset 1 limit 1", repo.Name, build.Branch).Scan(&prevStatus)
+		err := database.QueryRow("select status from build join repo on build.repo_id = repo.id and repo.name = $1 and build.branch = $2 where build.id < $3 and build.status != 'cancelled' and build.variant = $4 order by build.id desc limit 1", repo.Name, build.Branch, build.ID, build.Variant).Scan(&prevStatus)
 		if r != nil && (err != nil || prevStatus == "success") {
 
 			// for build.LastLine
@@ -150,18 +180,35 @@ func _doBuild(repo Repo, build Build, buildDir string) {
 		})
 	}
 
-	env := []string{
-		"BUILDDIR=" + buildDir,
-		"CHECKOUTPATH=" + repo.CheckoutPath,
-		fmt.Sprintf("HOME=%s/home", buildDir),
-		fmt.Sprintf("BUILDID=%d", build.ID),
-		"REPONAME=" + repo.Name,
-		"BRANCH=" + build.Branch,
-		"COMMIT=" + build.CommitHash,
+	builtin := map[string]string{
+		"BUILDDIR":     buildDir,
+		"CHECKOUTPATH": repo.CheckoutPath,
+		"HOME":         buildDir + "/home",
+		"BUILDID":      fmt.Sprintf("%d", build.ID),
+		"REPONAME":     repo.Name,
+		"BRANCH":       build.Branch,
+		"COMMIT":       build.CommitHash,
+	}
+	repoEnv := map[string]string{}
+	transact(func(tx *sql.Tx) {
+		for _, v := range _repoEnv(tx, repo.ID) {
+			repoEnv[v.Key] = v.Value
+		}
+		setBuildMasker(build.ID, newMasker(_repoSecrets(tx, repo)))
+	})
+	if repo.Cache {
+		builtin["CACHEDIR"] = buildDir + "/cache"
 	}
-	for key, value := range config.Environment {
-		env = append(env, key+"="+value)
+	var variantEnv map[string]string
+	if build.Variant != "" {
+		v, ok := matrixVariant(repo, build.Variant)
+		if !ok {
+			userError(fmt.Sprintf("Variant %q no longer in build matrix.", build.Variant))
+		}
+		variantEnv = v.Env
+		builtin["VARIANT"] = v.Name
 	}
+	env := mergeEnv(config.Environment, repoEnv, variantEnv, builtin)
 
 	execCommand := func(args ...string) *exec.Cmd {
 		return exec.Command(args[0], args[1:]...)
@@ -174,28 +221,81 @@ func _doBuild(repo Repo, build Build, buildDir string) {
 		return args
 	}
 
+	// stop between steps if the build was cancelled
+	checkCancelled := func() {
+		if buildCancelled(build.ID) {
+			userError(cancelledMsg)
+		}
+	}
+
+	// builds for repositories with agent labels run on an agent, we only keep track of them
+	if len(repo.AgentLabels) > 0 {
+		checkCancelled()
+		stepNames := buildStepNames(buildDir)
+		_doAgentBuild(repo, &build, buildDir, env, stepNames)
+		_finishBuild(repo, build, buildDir, stepNames)
+		return
+	}
+
+	checkCancelled()
 	_updateStatus("clone")
-	var err error
-	switch repo.VCS {
-	case "git":
-		// we clone without hard links because we chown later, don't want to mess up local git source repo's
-		// we have to clone as the user running ding. otherwise, git clone won't work due to ssh refusing to run as a user without a username ("No user exists for uid ...")
-		err = run(build.ID, env, "clone", buildDir, buildDir, runPrefix("git", "clone", "--recursive", "--no-hardlinks", "--branch", build.Branch, repo.Origin, "checkout/"+repo.CheckoutPath)...)
-		sherpaUserCheck(err, "cloning git repository")
-	case "mercurial":
-		cmd := []string{"hg", "clone", "--branch", build.Branch}
-		if build.CommitHash != "" {
-			cmd = append(cmd, "--rev", build.CommitHash, "--updaterev", build.CommitHash)
-		}
-		cmd = append(cmd, repo.Origin, "checkout/"+repo.CheckoutPath)
-		err = run(build.ID, env, "clone", buildDir, buildDir, runPrefix(cmd...)...)
-		sherpaUserCheck(err, "cloning mercurial repository")
-	case "command":
-		err = run(build.ID, env, "clone", buildDir, buildDir, runPrefix("sh", "-c", repo.Origin)...)
-		sherpaUserCheck(err, "cloning repository from command")
-	default:
-		serverError("unexpected VCS " + repo.VCS)
+	var cloneDeadline time.Time
+	if repo.CloneTimeout > 0 {
+		cloneDeadline = time.Now().Add(time.Duration(repo.CloneTimeout) * time.Second)
 	}
+	runClone := func(workDir string, args ...string) error {
+		return run(build.ID, env, "clone", buildDir, workDir, cloneDeadline, runPrefix(args...)...)
+	}
+	// for git and mercurial, we keep a local mirror of the origin, so we only fetch new changes
+	var mirror bool
+	if repo.VCS == "git" || repo.VCS == "mercurial" {
+		mirror = updateMirror(repo, runClone)
+	}
+	var err error
+	func() {
+		if mirror {
+			// the mirror must not be updated while we clone from it
+			l := mirrorLock(repo.Name)
+			l.RLock()
+			defer l.RUnlock()
+		}
+
+		switch repo.VCS {
+		case "git":
+			// we clone without hard links because we chown later, don't want to mess up local git source repo's
+			// we have to clone as the user running ding. otherwise, git clone won't work due to ssh refusing to run as a user without a username ("No user exists for uid ...")
+			cmd := []string{"git", "clone", "--recursive", "--no-hardlinks", "--branch", build.Branch}
+			if mirror {
+				// objects come from the mirror, and are copied so the checkout does not depend on it
+				cmd = append(cmd, "--reference", mirrorDir(repo.Name), "--dissociate")
+			}
+			cmd = append(cmd, repo.Origin, "checkout/"+repo.CheckoutPath)
+			err = runClone(buildDir, cmd...)
+			sherpaUserCheck(err, "cloning git repository")
+		case "mercurial":
+			origin := repo.Origin
+			if mirror {
+				origin = mirrorDir(repo.Name)
+			}
+			// with --pull, files are copied instead of hard linked, like for git
+			cmd := []string{"hg", "clone", "--pull", "--branch", build.Branch}
+			if build.CommitHash != "" {
+				cmd = append(cmd, "--rev", build.CommitHash, "--updaterev", build.CommitHash)
+			}
+			cmd = append(cmd, origin, "checkout/"+repo.CheckoutPath)
+			err = runClone(buildDir, cmd...)
+			sherpaUserCheck(err, "cloning mercurial repository")
+			if mirror {
+				// point the checkout to the origin, not our mirror
+				writeFile(fmt.Sprintf("%s/checkout/%s/.hg/hgrc", buildDir, repo.CheckoutPath), fmt.Sprintf("[paths]\ndefault = %s\n", repo.Origin))
+			}
+		case "command":
+			err = runClone(buildDir, "sh", "-c", repo.Origin)
+			sherpaUserCheck(err, "cloning repository from command")
+		default:
+			serverError("unexpected VCS " + repo.VCS)
+		}
+	}()
 
 	checkoutDir := fmt.Sprintf("%s/checkout/%s", buildDir, repo.CheckoutPath)
 
@@ -236,12 +336,24 @@ func _doBuild(repo Repo, build Build, buildDir string) {
 	}
 
 	if repo.VCS == "git" {
-		err = run(build.ID, env, "clone", buildDir, checkoutDir, runPrefix("git", "checkout", build.CommitHash)...)
+		err = run(build.ID, env, "clone", buildDir, checkoutDir, cloneDeadline, runPrefix("git", "checkout", build.CommitHash)...)
 		sherpaUserCheck(err, "checkout revision")
 	}
 
+	cacheSaved := false
+	if repo.Cache {
+		// the build works on a copy of the cache dir, which replaces the cache dir if the build succeeds
+		checkCancelled()
+		_restoreCache(repo.Name, build.ID)
+		defer func() {
+			if !cacheSaved {
+				removeBuildCache(repo.Name, build.ID)
+			}
+		}()
+	}
+
 	req := request{
-		msg{msgChown, repo.Name, build.ID, repo.CheckoutPath, nil},
+		msg{Kind: msgChown, RepoName: repo.Name, BuildID: build.ID, CheckoutPath: repo.CheckoutPath, Cache: repo.Cache},
 		make(chan error, 0),
 		nil,
 	}
@@ -249,51 +361,82 @@ func _doBuild(repo Repo, build Build, buildDir string) {
 	err = <-req.errorResponse
 	sherpaCheck(err, "chown")
 
-	_updateStatus("build")
-	req = request{
-		msg{msgBuild, repo.Name, build.ID, repo.CheckoutPath, env},
-		nil,
-		make(chan buildResult, 0),
-	}
-	rootRequests <- req
-	result := <-req.buildResponse
-	if result.err != nil {
-		sherpaUserCheck(result.err, "building")
-	}
+	limits := buildLimits(repo)
+	stepNames := buildStepNames(buildDir)
+	for _, stepName := range stepNames {
+		checkCancelled()
+		_updateStatus(stepName)
+		req = request{
+			msg{Kind: msgBuild, RepoName: repo.Name, BuildID: build.ID, CheckoutPath: repo.CheckoutPath, Step: stepName, Cache: repo.Cache, Env: append(env, "STEP="+stepName), Timeout: repo.BuildTimeout, Limits: limits, Sandbox: buildSandbox(repo), IsolateNetwork: repo.IsolateNetwork},
+			nil,
+			make(chan buildResult, 0),
+		}
+		rootRequests <- req
+		result := <-req.buildResponse
+		if result.err != nil {
+			sherpaUserCheck(result.err, "starting step "+stepName)
+		}
+		if buildCancelled(build.ID) {
+			// cancelled while the root process was starting the script
+			_cancelRootBuild(repo.Name, build.ID)
+		}
 
-	wait := make(chan error, 1)
-	go func() {
-		defer result.status.Close()
+		wait := make(chan error, 1)
+		go func() {
+			defer result.status.Close()
 
-		var r string
-		err = gob.NewDecoder(result.status).Decode(&r)
-		check(err, "decoding gob from result.status")
-		var err error
-		if r != "" {
-			err = fmt.Errorf("%s", r)
+			var r string
+			err := gob.NewDecoder(result.status).Decode(&r)
+			check(err, "decoding gob from result.status")
+			if r != "" {
+				err = fmt.Errorf("%s", r)
+			}
+			wait <- err
+		}()
+		err = track(build.ID, stepName, buildDir, result.stdout, result.stderr, wait)
+		if err != nil && !limits.isZero() && !strings.Contains(err.Error(), " limit ") {
+			if hint := limitHint(limits, readFileLax(buildDir+"/output/"+stepName+".stderr")); hint != "" {
+				err = fmt.Errorf("%s (%s)", err, hint)
+			}
 		}
-		wait <- err
-	}()
-	err = track(build.ID, "build", buildDir, result.stdout, result.stderr, wait)
-	sherpaUserCheck(err, "running command")
+		sherpaUserCheck(err, "running step "+stepName)
+	}
+
+	if repo.Cache {
+		_saveCache(repo.Name, build.ID)
+		cacheSaved = true
+	}
+	_finishBuild(repo, build, buildDir, stepNames)
+}
 
+// _finishBuild stores the results of a build whose steps all succeeded, marks it as successful, and triggers builds that depend on it.
+func _finishBuild(repo Repo, build Build, buildDir string, stepNames []string) {
+	checkoutDir := fmt.Sprintf("%s/checkout/%s", buildDir, repo.CheckoutPath)
 	build.DiskUsage = buildDiskUsage(buildDir)
 	transact(func(tx *sql.Tx) {
 		outputDir := buildDir + "/output"
-		results := parseResults(checkoutDir, outputDir+"/build.stdout")
+		var results []Result
+		for _, stepName := range stepNames {
+			results = append(results, parseResults(checkoutDir, outputDir+"/"+stepName+".stdout")...)
+		}
 
-		qins := `insert into result (build_id, command, version, os, arch, toolchain, filename, filesize) values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+		qins := `insert into result (build_id, command, version, os, arch, toolchain, filename, filesize, sha256) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
 		for _, result := range results {
 			var id int
-			err = tx.QueryRow(qins, build.ID, result.Command, result.Version, result.Os, result.Arch, result.Toolchain, result.Filename, result.Filesize).Scan(&id)
+			err := tx.QueryRow(qins, build.ID, result.Command, result.Version, result.Os, result.Arch, result.Toolchain, result.Filename, result.Filesize, result.Sha256).Scan(&id)
 			sherpaCheck(err, "inserting result into database")
 		}
 
-		_, err = tx.Exec("update build set status='success', finish=NOW(), disk_usage=$1 where id=$2", build.DiskUsage, build.ID)
+		_, err := tx.Exec("update build set status='success', finish=NOW(), disk_usage=$1 where id=$2", build.DiskUsage, build.ID)
 		sherpaCheck(err, "marking build as success in database")
 
 		events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
 	})
+
+	// variants of a build matrix don't trigger builds, the build that started them does when all succeed
+	if build.ParentID == nil {
+		triggerBuilds(repo, build)
+	}
 }
 
 func _cleanupBuilds(repoName, branch string) {
@@ -303,13 +446,13 @@ func _cleanupBuilds(repoName, branch string) {
 		from (
 			select build.*
 			from build join repo on build.repo_id = repo.id
-			where repo.name=$1 and build.branch=$2
+			where repo.name=$1 and build.branch=$2 and build.parent_id is null
 		) x
 	`
 	sherpaCheckRow(database.QueryRow(q, repoName, branch), &builds, "fetching builds from database")
 	now := time.Now()
 	for index, b := range builds {
-		if index == 0 || b.Released != nil {
+		if index == 0 || b.Released != nil || childReleased(b.ID) {
 			continue
 		}
 		if index >= 10 || (b.Finish != nil && now.Sub(*b.Finish) > 14*24*3600*time.Second) {
@@ -339,12 +482,14 @@ func parseResults(checkoutDir, path string) (results []Result) {
 		if len(t) != 7 {
 			sherpaUserCheck(err, "invalid output line, should have 7 words: "+line)
 		}
-		result := Result{t[1], t[2], t[3], t[4], t[5], t[6], 0}
+		result := Result{t[1], t[2], t[3], t[4], t[5], t[6], 0, ""}
 		if !strings.HasPrefix(result.Filename, "/") {
 			result.Filename = checkoutDir + "/" + result.Filename
 		}
 		info, err := os.Stat(result.Filename)
 		sherpaUserCheck(err, "testing whether released file exists")
+		result.Sha256, err = fileSha256(result.Filename)
+		sherpaUserCheck(err, "calculating checksum of released file")
 		result.Filename = result.Filename[len(checkoutDir+"/"):]
 		result.Filesize = info.Size()
 		results = append(results, result)
@@ -354,9 +499,24 @@ func parseResults(checkoutDir, path string) (results []Result) {
 	return
 }
 
+// fileSha256 returns the hex-encoded SHA-256 of the contents of a file.
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // start a command and return readers for its output and the final result of the command.
 // it mimics a command started through the root process under a unique uid.
-func setupCmd(buildID int, env []string, step, buildDir, workDir string, args ...string) (stdout, stderr io.ReadCloser, wait <-chan error, rerr error) {
+// if deadline is not zero, the command and its children are killed when it is reached.
+func setupCmd(buildID int, env []string, step, buildDir, workDir string, deadline time.Time, args ...string) (stdout, stderr io.ReadCloser, wait <-chan error, rerr error) {
 	type Error struct {
 		err error
 	}
@@ -413,23 +573,43 @@ func setupCmd(buildID int, env []string, step, buildDir, workDir string, args ..
 			stdoutw,
 			stderrw,
 		},
+		// in its own process group, so we can kill it with all its children when the build is cancelled
+		Sys: &syscall.SysProcAttr{
+			Setpgid: true,
+		},
 	}
 	proc, err := os.StartProcess(args[0], args, attr)
 	xcheck(err, "command start")
+	cmdStarted(buildID, proc.Pid)
+
+	var timedOut int32
+	var timer *time.Timer
+	if !deadline.IsZero() {
+		timer = time.AfterFunc(time.Until(deadline), func() {
+			atomic.StoreInt32(&timedOut, 1)
+			killProcessGroup(proc.Pid)
+		})
+	}
 
 	c := make(chan error, 1)
 	go func() {
 		state, err := proc.Wait()
-		if err == nil && !state.Success() {
-			err = fmt.Errorf(state.String())
+		if timer != nil {
+			timer.Stop()
+		}
+		cmdFinished(buildID)
+		if atomic.LoadInt32(&timedOut) != 0 {
+			err = fmt.Errorf("timeout for %s step reached", step)
+		} else if err == nil && !state.Success() {
+			err = errors.New(state.String())
 		}
 		c <- err
 	}()
 	return stdoutr, stderrr, c, nil
 }
 
-func run(buildID int, env []string, step, buildDir, workDir string, args ...string) error {
-	cmdstdout, cmdstderr, wait, err := setupCmd(buildID, env, step, buildDir, workDir, args...)
+func run(buildID int, env []string, step, buildDir, workDir string, deadline time.Time, args ...string) error {
+	cmdstdout, cmdstderr, wait, err := setupCmd(buildID, env, step, buildDir, workDir, deadline, args...)
 	if err != nil {
 		return fmt.Errorf("setting up command: %s", err)
 	}
@@ -485,10 +665,25 @@ func track(buildID int, step, buildDir string, cmdstdout, cmdstderr io.ReadClose
 	stderr, err := os.OpenFile(buildDir+"/output/"+step+".stderr", appendFlags, 0644)
 	xcheck(err, "creating stderr file")
 	defer stderr.Close()
+	sections, err := os.OpenFile(buildDir+"/output/"+step+".sections", appendFlags, 0644)
+	xcheck(err, "creating sections file")
+	defer sections.Close()
+	var section string                // current section, from the last "step:<name>" line on stdout
+	var stdoutLines sectionLineReader // stdout gathered into whole lines, for recognizing section markers
+	startSections := func(names []string) {
+		for _, name := range names {
+			section = name
+			_, err := fmt.Fprintf(sections, "%d %s\n", time.Now().Sub(t0), name)
+			xcheck(err, "writing to sections")
+		}
+	}
 
 	// let it be known that we started this phase
 	events <- EventOutput{buildID, step, "stdout", ""}
 
+	// secrets are masked before output is stored or sent to clients
+	masker := buildMasker(buildID)
+
 	// first we read all the data from stdout & stderr
 	type Lines struct {
 		text   string
@@ -497,37 +692,14 @@ func track(buildID int, step, buildDir string, cmdstdout, cmdstderr io.ReadClose
 	}
 	lines := make(chan Lines, 0)
 	linereader := func(r io.ReadCloser, stdout bool) {
-		buf := make([]byte, 1024)
-		have := 0
-		for {
-			//log.Println("calling read")
-			n, err := r.Read(buf[have:])
-			//log.Println("read returned")
-			if n > 0 {
-				have += n
-				end := bytes.LastIndexByte(buf[:have], '\n')
-				if end < 0 && have == len(buf) {
-					// cannot gather any more data, flush it
-					end = len(buf)
-				} else if end < 0 {
-					continue
-				} else {
-					// include the newline
-					end++
-				}
-				lines <- Lines{string(buf[:end]), stdout, nil}
-				copy(buf[:], buf[end:have])
-				have -= end
-			}
-			if err == io.EOF {
-				lines <- Lines{"", stdout, nil}
-				break
-			}
-			if err != nil {
-				lines <- Lines{stdout: stdout, err: err}
-				return
-			}
+		err := readOutput(r, masker, func(text string) {
+			lines <- Lines{text, stdout, nil}
+		})
+		if err != nil {
+			lines <- Lines{stdout: stdout, err: err}
+			return
 		}
+		lines <- Lines{"", stdout, nil}
 	}
 	//log.Println("new command, reading input")
 	go linereader(cmdstdout, true)
@@ -554,6 +726,7 @@ func track(buildID int, step, buildDir string, cmdstdout, cmdstderr io.ReadClose
 			where = "stdout"
 			_, err = stdout.Write([]byte(l.text))
 			xcheck(err, "writing to stdout")
+			startSections(stdoutLines.add(l.text))
 		} else {
 			where = "stderr"
 			_, err = stderr.Write([]byte(l.text))
@@ -562,11 +735,55 @@ func track(buildID int, step, buildDir string, cmdstdout, cmdstderr io.ReadClose
 		events <- EventOutput{buildID, step, where, l.text}
 	}
 
+	startSections(stdoutLines.flush())
+
 	// second, we wait for the command result
-	xcheck(<-wait, "command failed")
+	xcheck(sectionError(<-wait, section), "command failed")
 	return
 }
 
+// readOutput reads output of a command from r, and calls emit with masked text until EOF.
+// Text is whole lines, unless a line does not fit in the buffer.
+func readOutput(r io.Reader, masker *masker, emit func(text string)) error {
+	// a secret must fit in the buffer, with room to flush text before it
+	bufSize := 1024
+	if n := 2 * (masker.keep() + 1); n > bufSize {
+		bufSize = n
+	}
+	buf := make([]byte, bufSize)
+	have := 0
+	for {
+		n, err := r.Read(buf[have:])
+		if n > 0 {
+			have += n
+			end := bytes.LastIndexByte(buf[:have], '\n')
+			if end < 0 && have == len(buf) {
+				// cannot gather any more data, flush it.
+				// except for a secret that would be split, and the last bytes that could be the start of a secret.
+				end = masker.flushPoint(string(buf[:have]))
+			} else if end < 0 {
+				continue
+			} else {
+				// include the newline
+				end++
+			}
+			emit(masker.mask(string(buf[:end])))
+			copy(buf[:], buf[end:have])
+			have -= end
+		}
+		if err == io.EOF {
+			if have > 0 {
+				// output without trailing newline
+				emit(masker.mask(string(buf[:have])))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // disk usage, best effort
 func buildDiskUsage(buildDir string) (diskUsage int64) {
 	filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
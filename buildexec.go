@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// buildExec prepares the process for running build.sh, then executes it.
+// The root process starts build.sh through this, since resource limits and the sandbox cannot be set up between fork and exec.
+// With a sandbox or network isolation, we start as root in new namespaces, set up the mounts and/or loopback interface,
+// and switch to the build uid/gid before executing build.sh.
+func buildExec(args []string) {
+	fs := flag.NewFlagSet("build-exec", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ding build-exec [flags] command")
+		fs.PrintDefaults()
+	}
+	as := fs.Int64("as", 0, "bytes of virtual memory per process")
+	nproc := fs.Int64("nproc", 0, "number of processes for the user")
+	fsize := fs.Int64("fsize", 0, "bytes, largest file that can be written")
+	nofile := fs.Int64("nofile", 0, "open files per process")
+	cpu := fs.Int64("cpu", 0, "seconds of cpu time per process")
+	sandboxDir := fs.String("sandbox", "", "if set, make file system read-only except for this directory, and mount a private /tmp")
+	loopback := fs.Bool("loopback", false, "bring up loopback interface, for a new network namespace")
+	uid := fs.Int("uid", -1, "if set, uid to switch to before executing command")
+	gid := fs.Int("gid", -1, "if set, gid to switch to before executing command")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *sandboxDir != "" {
+		setupSandbox(*sandboxDir)
+	}
+	if *loopback {
+		setupLoopback()
+	}
+
+	if *gid >= 0 {
+		check(syscall.Setgroups([]int{}), "clearing supplementary groups")
+		check(syscall.Setgid(*gid), "setting gid")
+	}
+	if *uid >= 0 {
+		check(syscall.Setuid(*uid), "setting uid")
+	}
+
+	setLimit := func(resource int, soft, hard int64, name string) {
+		if soft <= 0 {
+			return
+		}
+		check(setrlimit(resource, soft, hard), "setting "+name+" limit")
+	}
+	setLimit(unix.RLIMIT_FSIZE, *fsize, *fsize, "file size")
+	setLimit(unix.RLIMIT_NOFILE, *nofile, *nofile, "open files")
+	// the soft limit sends SIGXCPU, giving processes a chance to report it. the hard limit kills them.
+	setLimit(unix.RLIMIT_CPU, *cpu, *cpu+5, "cpu time")
+	setLimit(rlimitProcesses, *nproc, *nproc, "processes")
+	// last, we don't want to run out of memory ourselves before exec
+	setLimit(rlimitAddressSpace, *as, *as, "address space")
+
+	err := syscall.Exec(args[0], args, os.Environ())
+	check(err, "executing command")
+}
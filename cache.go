@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the cache dir of a repository is locked while it is copied to or replaced by a build, or cleared
+var cacheLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: map[string]*sync.Mutex{}}
+
+// lockCache waits until the cache dir of the repository is not in use, and returns a function to release it.
+func lockCache(repoName string) func() {
+	cacheLocks.Lock()
+	l, ok := cacheLocks.m[repoName]
+	if !ok {
+		l = &sync.Mutex{}
+		cacheLocks.m[repoName] = l
+	}
+	cacheLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func cacheDir(repoName string) string {
+	return fmt.Sprintf("%s/data/cache/%s", dingWorkDir, repoName)
+}
+
+// _updateCacheUsage stores the disk usage of the cache dir of the repository.
+func _updateCacheUsage(repoName string) {
+	du := buildDiskUsage(cacheDir(repoName))
+	transact(func(tx *sql.Tx) {
+		_, err := tx.Exec(`update repo set cache_disk_usage=$1 where name=$2`, du, repoName)
+		sherpaCheck(err, "updating cache disk usage in database")
+	})
+}
+
+// cacheRequest asks the root process to restore, save or remove a cache dir, its files can be owned by build uids.
+// The root process works on the cache dir in the background, this waits until it is done.
+func cacheRequest(kind msgKind, repoName string, buildID int) error {
+	req := request{msg{Kind: kind, RepoName: repoName, BuildID: buildID}, nil, make(chan buildResult, 0)}
+	rootRequests <- req
+	result := <-req.buildResponse
+	if result.err != nil {
+		return result.err
+	}
+	defer result.status.Close()
+	var r string
+	if err := gob.NewDecoder(result.status).Decode(&r); err != nil {
+		return fmt.Errorf("reading result of cache request: %s", err)
+	}
+	if r != "" {
+		return fmt.Errorf("%s", r)
+	}
+	return nil
+}
+
+// _removeCache removes the cache dir of the repository.
+func _removeCache(repoName string) {
+	err := cacheRequest(msgRemoveCache, repoName, -1)
+	sherpaCheck(err, "removing cache dir")
+}
+
+// _restoreCache gives a build a copy of the cache dir of the repository, as <builddir>/cache.
+// Builds work on their own copy, so builds of a repository can run at the same time.
+func _restoreCache(repoName string, buildID int) {
+	unlock := lockCache(repoName)
+	defer unlock()
+	err := cacheRequest(msgRestoreCache, repoName, buildID)
+	sherpaCheck(err, "restoring cache dir")
+}
+
+// _saveCache makes the copy of a successful build the new cache dir of the repository.
+// When builds run at the same time, the last build to finish determines the cache.
+func _saveCache(repoName string, buildID int) {
+	unlock := lockCache(repoName)
+	err := cacheRequest(msgSaveCache, repoName, buildID)
+	unlock()
+	sherpaCheck(err, "saving cache dir")
+	_updateCacheUsage(repoName)
+}
+
+// removeBuildCache removes the copy of the cache dir of a build that was not saved, eg because the build failed.
+// Errors are logged, this is called while cleaning up.
+func removeBuildCache(repoName string, buildID int) {
+	if err := cacheRequest(msgRemoveCache, repoName, buildID); err != nil {
+		log.Printf("removing cache dir of build %d for repo %s: %s\n", buildID, repoName, err)
+	}
+}
+
+// copyDir copies the directories, regular files and symlinks in src to dst, which must not yet exist. Called by the root process.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		p := dst + strings.TrimPrefix(path, src)
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			// tools like go make their cache dirs read-only, we need to be able to write in and remove our copy
+			return os.Mkdir(p, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err == nil {
+				err = os.Symlink(target, p)
+			}
+			return err
+		case mode.IsRegular():
+			return copyFile(path, p, info)
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, info os.FileInfo) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(df, sf)
+	if xerr := df.Close(); err == nil {
+		err = xerr
+	}
+	if err == nil {
+		// some tools check modification times of cached files
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return err
+}
+
+// removeTree removes dir and all its contents, also if builds made directories in it read-only. Called by the root process.
+func removeTree(dir string) error {
+	err := os.RemoveAll(dir)
+	if err == nil || os.Geteuid() == 0 {
+		return err
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// ClearRepoCache removes all files from the cache dir of a repository.
+// Running builds keep their copy, and replace the cache again if they succeed.
+func (Ding) ClearRepoCache(repoName string) (repo Repo) {
+	transact(func(tx *sql.Tx) {
+		repo = _repo(tx, repoName)
+	})
+	unlock := lockCache(repo.Name)
+	defer unlock()
+	_removeCache(repo.Name)
+	transact(func(tx *sql.Tx) {
+		q := `update repo set cache_disk_usage=0 where id=$1 returning row_to_json(repo.*)`
+		sherpaCheckRow(tx.QueryRow(q, repo.ID), &repo, "updating cache disk usage in database")
+	})
+	return
+}
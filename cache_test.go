@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCopyDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ding-cache")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer removeTree(tmp)
+
+	src := tmp + "/src"
+	tm := time.Unix(1500000000, 0)
+	if err := os.MkdirAll(src+"/mod/pkg", 0777); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := ioutil.WriteFile(src+"/mod/pkg/file.go", []byte("package pkg\n"), 0444); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := os.Chtimes(src+"/mod/pkg/file.go", tm, tm); err != nil {
+		t.Fatalf("chtimes: %s", err)
+	}
+	if err := os.Symlink("pkg/file.go", src+"/mod/link"); err != nil {
+		t.Fatalf("symlink: %s", err)
+	}
+	// like the go module cache
+	if err := os.Chmod(src+"/mod/pkg", 0555); err != nil {
+		t.Fatalf("chmod: %s", err)
+	}
+
+	dst := tmp + "/dst"
+	if err := copyDir(src, dst); err != nil {
+		t.Fatalf("copyDir: %s", err)
+	}
+	buf, err := ioutil.ReadFile(dst + "/mod/link")
+	if err != nil || string(buf) != "package pkg\n" {
+		t.Fatalf("reading copied file through symlink: got %q, %v", buf, err)
+	}
+	fi, err := os.Stat(dst + "/mod/pkg/file.go")
+	if err != nil || fi.Mode().Perm() != 0444 || !fi.ModTime().Equal(tm) {
+		t.Fatalf("stat copied file: got %v, %v", fi, err)
+	}
+
+	for _, dir := range []string{src, dst} {
+		if err := removeTree(dir); err != nil {
+			t.Fatalf("removeTree %s: %s", dir, err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists after removeTree: %v", dir, err)
+		}
+	}
+}
+
+func TestRestoreSaveCache(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ding-cache")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer removeTree(tmp)
+	origWorkDir := dingWorkDir
+	dingWorkDir = tmp
+	defer func() {
+		dingWorkDir = origWorkDir
+	}()
+
+	buildCache := func(buildID int) string {
+		dir := fmt.Sprintf("%s/data/build/repo/%d", tmp, buildID)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatalf("mkdir: %s", err)
+		}
+		return dir + "/cache"
+	}
+	for _, id := range []int{1, 2, 3} {
+		buildCache(id)
+	}
+
+	// without a cache dir, a build gets an empty copy
+	if err := restoreCache("repo", 1); err != nil {
+		t.Fatalf("restoring missing cache: %s", err)
+	}
+	if err := ioutil.WriteFile(buildCache(1)+"/file", []byte("build 1"), 0666); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := saveCache("repo", 1); err != nil {
+		t.Fatalf("saving cache: %s", err)
+	}
+	if _, err := os.Stat(buildCache(1)); !os.IsNotExist(err) {
+		t.Fatalf("copy of build still exists after save: %v", err)
+	}
+
+	if err := restoreCache("repo", 2); err != nil {
+		t.Fatalf("restoring cache: %s", err)
+	}
+	if buf, err := ioutil.ReadFile(buildCache(2) + "/file"); err != nil || string(buf) != "build 1" {
+		t.Fatalf("reading restored file: got %q, %v", buf, err)
+	}
+	if err := ioutil.WriteFile(buildCache(2)+"/file", []byte("build 2"), 0666); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := saveCache("repo", 2); err != nil {
+		t.Fatalf("saving cache: %s", err)
+	}
+	if buf, err := ioutil.ReadFile(cacheDir("repo") + "/file"); err != nil || string(buf) != "build 2" {
+		t.Fatalf("reading saved file: got %q, %v", buf, err)
+	}
+
+	if err := restoreCache("repo", 3); err != nil {
+		t.Fatalf("restoring cache: %s", err)
+	}
+	if err := removeCache("repo", 3); err != nil {
+		t.Fatalf("removing copy of build: %s", err)
+	}
+	if err := removeCache("repo", -1); err != nil {
+		t.Fatalf("removing cache: %s", err)
+	}
+	for _, dir := range []string{buildCache(3), cacheDir("repo"), cacheDir("repo") + ".old"} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%s still exists: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// activeBuild is a build that is queued or running, as tracked by the http process.
+type activeBuild struct {
+	cancelled bool
+	pid       int // process (group) of command started by the http process, eg for cloning. 0 if none.
+	masker    *masker
+}
+
+var activeBuilds = struct {
+	sync.Mutex
+	m map[int]*activeBuild
+}{m: map[int]*activeBuild{}}
+
+func registerBuild(buildID int) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	activeBuilds.m[buildID] = &activeBuild{}
+}
+
+func unregisterBuild(buildID int) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	delete(activeBuilds.m, buildID)
+}
+
+// setBuildMasker sets the masker for secrets in the output of a build.
+func setBuildMasker(buildID int, m *masker) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	if ab, ok := activeBuilds.m[buildID]; ok {
+		ab.masker = m
+	}
+}
+
+// buildMasker returns the masker for secrets in the output of a build, nil if it has no secrets.
+func buildMasker(buildID int) *masker {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	if ab, ok := activeBuilds.m[buildID]; ok {
+		return ab.masker
+	}
+	return nil
+}
+
+func buildCancelled(buildID int) bool {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	ab, ok := activeBuilds.m[buildID]
+	return ok && ab.cancelled
+}
+
+// cmdStarted registers the process group of a command started for a build.
+// If the build was cancelled in the meantime, the command is killed immediately.
+func cmdStarted(buildID, pid int) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	ab, ok := activeBuilds.m[buildID]
+	if !ok {
+		return
+	}
+	ab.pid = pid
+	if ab.cancelled {
+		killProcessGroup(pid)
+	}
+}
+
+func cmdFinished(buildID int) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	if ab, ok := activeBuilds.m[buildID]; ok {
+		ab.pid = 0
+	}
+}
+
+// cancelActiveBuild marks a build as cancelled and kills the command the http process is running for it, if any.
+// It returns whether the build is queued or running.
+func cancelActiveBuild(buildID int) bool {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	ab, ok := activeBuilds.m[buildID]
+	if !ok {
+		return false
+	}
+	ab.cancelled = true
+	if ab.pid != 0 {
+		killProcessGroup(ab.pid)
+	}
+	return true
+}
+
+func killProcessGroup(pid int) {
+	err := unix.Kill(-pid, unix.SIGKILL)
+	if err != nil && err != unix.ESRCH {
+		log.Printf("killing process group %d: %s\n", pid, err)
+	}
+}
+
+// cancelBuild cancels a queued or running build, removing it from the queue or killing its running command.
+// It returns false if the build is not queued or running.
+func cancelBuild(repoName string, buildID int) bool {
+	if !cancelActiveBuild(buildID) {
+		return false
+	}
+	c := cancelJob{buildID, make(chan bool)}
+	cancelJobs <- c
+	if !<-c.rc {
+		_cancelRootBuild(repoName, buildID)
+	}
+	return true
+}
+
+// _cancelRootBuild asks the root process to kill the build.sh process group of a build.
+func _cancelRootBuild(repoName string, buildID int) {
+	req := request{msg{Kind: msgCancel, RepoName: repoName, BuildID: buildID}, make(chan error, 0), nil}
+	rootRequests <- req
+	err := <-req.errorResponse
+	sherpaCheck(err, "cancelling build")
+}
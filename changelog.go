@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// max number of commits stored in a changelog, the first release of a repository would otherwise get its entire history
+const maxChangelogCommits = 1000
+
+// Changelog lists the commits that went into a release since the previous release of the repository.
+type Changelog struct {
+	PreviousBuildID    *int     `json:"previous_build_id"`    // previous release, null for the first release
+	PreviousCommitHash string   `json:"previous_commit_hash"` // commit of previous release, empty for the first release
+	Commits            []Commit `json:"commits"`              // newest first
+	Truncated          bool     `json:"truncated"`            // whether there were more commits than stored
+}
+
+// Commit is a commit in a changelog.
+type Commit struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+	Subject string    `json:"subject"` // first line of the commit message
+}
+
+// _changelog generates the changelog for releasing build, from the previous release of the repository.
+// The log is read from the mirror of the repository.
+// It returns nil if no changelog could be generated, eg for repositories with vcs `command`.
+func _changelog(tx *sql.Tx, repo Repo, build Build) *Changelog {
+	if build.CommitHash == "" || repo.VCS != "git" && repo.VCS != "mercurial" {
+		return nil
+	}
+
+	cl := &Changelog{Commits: []Commit{}}
+	// variants of the same build matrix share their commit, the previous release is from another build
+	q := `
+		select id, commit_hash
+		from build
+		where repo_id=$1 and released is not null and id<>$2 and ($3::int is null or parent_id is null or parent_id<>$3)
+		order by released desc
+		limit 1
+	`
+	var prevID int
+	err := tx.QueryRow(q, repo.ID, build.ID, build.ParentID).Scan(&prevID, &cl.PreviousCommitHash)
+	if err == nil {
+		cl.PreviousBuildID = &prevID
+	} else if err != sql.ErrNoRows {
+		sherpaCheck(err, "fetching previous release from database")
+	}
+
+	// the log is only read from the mirror, which is owned by ding. the checkout is writable by the build,
+	// and its repository config could make git or hg run commands.
+	dir := mirrorDir(repo.Name)
+	if _, err := os.Stat(dir); err != nil {
+		log.Printf("changelog for build %d: no mirror of repository %s\n", build.ID, repo.Name)
+		return nil
+	}
+	l := mirrorLock(repo.Name)
+	l.RLock()
+	commits, err := logCommits(repo.VCS, dir, cl.PreviousCommitHash, build.CommitHash)
+	l.RUnlock()
+	if err != nil {
+		log.Printf("changelog for build %d: %s\n", build.ID, err)
+		return nil
+	}
+	if len(commits) > maxChangelogCommits {
+		commits = commits[:maxChangelogCommits]
+		cl.Truncated = true
+	}
+	cl.Commits = commits
+	return cl
+}
+
+// logCommits returns the commits in the repository at dir that are in commit but not in prev, newest first.
+// If prev is empty, all ancestors of commit are returned.
+// At most maxChangelogCommits+1 commits are returned, to detect truncation.
+func logCommits(vcs, dir, prev, commit string) ([]Commit, error) {
+	limit := fmt.Sprintf("%d", maxChangelogCommits+1)
+	var args []string
+	switch vcs {
+	case "git":
+		rev := commit
+		if prev != "" {
+			rev = prev + ".." + commit
+		}
+		args = []string{"git", "-C", dir, "log", "-n", limit, "--format=%H%x00%an%x00%aI%x00%s", rev, "--"}
+	case "mercurial":
+		rev := fmt.Sprintf("reverse(::%s)", commit)
+		if prev != "" {
+			rev = fmt.Sprintf("reverse(only(%s, %s))", commit, prev)
+		}
+		args = []string{"hg", "-R", dir, "log", "-l", limit, "-r", rev, "--template", `{node}\0{author|person}\0{date|rfc3339date}\0{desc|firstline}\n`}
+	default:
+		return nil, fmt.Errorf("no changelog for vcs %q", vcs)
+	}
+	out, err := vcsCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+	commits := []Commit{}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		t := strings.Split(line, "\x00")
+		if len(t) != 4 {
+			return nil, fmt.Errorf("unexpected line in log output: %q", line)
+		}
+		tm, err := time.Parse(time.RFC3339, t[2])
+		if err != nil {
+			return nil, fmt.Errorf("parsing commit time: %s", err)
+		}
+		commits = append(commits, Commit{t[0], t[1], tm, t[3]})
+	}
+	return commits, nil
+}
+
+// formatChangelog returns release notes for a release as plain text, or markdown.
+func formatChangelog(repoName string, build Build, cl *Changelog, markdown bool) []byte {
+	version := ""
+	if len(build.Results) > 0 {
+		version = build.Results[0].Version
+	}
+	short := func(hash string) string {
+		if len(hash) > 12 {
+			return hash[:12]
+		}
+		return hash
+	}
+
+	var b bytes.Buffer
+	title := strings.TrimSpace(fmt.Sprintf("%s %s", repoName, version))
+	if markdown {
+		fmt.Fprintf(&b, "# %s\n\n", title)
+	} else {
+		fmt.Fprintf(&b, "%s\n%s\n\n", title, strings.Repeat("=", len(title)))
+	}
+	released := ""
+	if build.Released != nil {
+		released = build.Released.Format("2006-01-02")
+	}
+	fmt.Fprintf(&b, "Released %s, build %d, branch %s, commit %s.\n\n", released, build.ID, build.Branch, build.CommitHash)
+	switch {
+	case cl == nil:
+		fmt.Fprintf(&b, "No changelog available.\n")
+		return b.Bytes()
+	case cl.PreviousBuildID == nil:
+		fmt.Fprintf(&b, "First release.\n\n")
+	default:
+		fmt.Fprintf(&b, "Changes since release of build %d, commit %s:\n\n", *cl.PreviousBuildID, short(cl.PreviousCommitHash))
+	}
+	if len(cl.Commits) == 0 {
+		fmt.Fprintf(&b, "No changes.\n")
+	}
+	for _, c := range cl.Commits {
+		if markdown {
+			fmt.Fprintf(&b, "- %s (`%s`, %s)\n", c.Subject, short(c.Hash), c.Author)
+		} else {
+			fmt.Fprintf(&b, "- %s (%s, %s)\n", c.Subject, short(c.Hash), c.Author)
+		}
+	}
+	if cl.Truncated {
+		fmt.Fprintf(&b, "\nOnly the last %d commits are listed.\n", maxChangelogCommits)
+	}
+	return b.Bytes()
+}
+
+// serveChangelog serves release notes for a release, at /changelog/<reponame>/<buildid>.{txt,md}.
+func serveChangelog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "bad method", 405)
+		return
+	}
+	t := strings.Split(r.URL.Path[1:], "/")
+	if len(t) != 3 || hasBadElems(t[1:]) {
+		http.NotFound(w, r)
+		return
+	}
+	repoName := t[1]
+	var markdown bool
+	var ext, contentType string
+	switch {
+	case strings.HasSuffix(t[2], ".txt"):
+		ext, contentType = ".txt", "text/plain; charset=utf-8"
+	case strings.HasSuffix(t[2], ".md"):
+		markdown = true
+		ext, contentType = ".md", "text/markdown; charset=utf-8"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	buildID, err := strconv.Atoi(strings.TrimSuffix(t[2], ext))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := `
+		select row_to_json(bwr.*), coalesce(release.changelog, 'null')
+		from build_with_result bwr
+		join repo on bwr.repo_id = repo.id
+		join release on bwr.id = release.build_id
+		where repo.name=$1 and bwr.id=$2
+	`
+	var buildBuf, changelogBuf []byte
+	err = database.QueryRow(q, repoName, buildID).Scan(&buildBuf, &changelogBuf)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	var build Build
+	var cl *Changelog
+	if err == nil {
+		err = json.Unmarshal(buildBuf, &build)
+	}
+	if err == nil {
+		err = json.Unmarshal(changelogBuf, &cl)
+	}
+	if err != nil {
+		log.Printf("changelog: fetching release: %s\n", err)
+		http.Error(w, "server error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(formatChangelog(repoName, build, cl, markdown))
+}
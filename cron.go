@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression with 5 fields: minute, hour, day of month, month, day of week.
+// Fields can be *, a number, a range a-b, with an optional step /n, and comma-separated lists of those.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool // whether the field was "*", for the usual cron rule combining day of month and day of week
+}
+
+func parseCronField(s string, min, max int) (map[int]bool, error) {
+	r := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			v, err := strconv.Atoi(part[i+1:])
+			if err != nil || v <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			step = v
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			t := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(t[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", t[0])
+			}
+			hi = lo
+			if len(t) == 2 {
+				hi, err = strconv.Atoi(t[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid number %q", t[1])
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range %d-%d in %q", min, max, part)
+		}
+		for v := lo; v <= hi; v += step {
+			r[v] = true
+		}
+	}
+	return r, nil
+}
+
+func parseCron(s string) (cs cronSchedule, err error) {
+	t := strings.Fields(s)
+	if len(t) != 5 {
+		return cs, fmt.Errorf("need 5 fields: minute, hour, day of month, month, day of week")
+	}
+	fields := []struct {
+		m        *map[int]bool
+		min, max int
+		name     string
+	}{
+		{&cs.minute, 0, 59, "minute"},
+		{&cs.hour, 0, 23, "hour"},
+		{&cs.dom, 1, 31, "day of month"},
+		{&cs.month, 1, 12, "month"},
+		{&cs.dow, 0, 7, "day of week"},
+	}
+	for i, f := range fields {
+		*f.m, err = parseCronField(t[i], f.min, f.max)
+		if err != nil {
+			return cs, fmt.Errorf("%s: %s", f.name, err)
+		}
+	}
+	// both 0 and 7 are sunday
+	if cs.dow[7] {
+		cs.dow[0] = true
+	}
+	cs.domAny = t[2] == "*"
+	cs.dowAny = t[4] == "*"
+	return cs, nil
+}
+
+// matches returns whether the schedule fires at the minute of tm.
+// Like cron, if both day of month and day of week are restricted, either one matching is enough.
+func (cs cronSchedule) matches(tm time.Time) bool {
+	if !cs.minute[tm.Minute()] || !cs.hour[tm.Hour()] || !cs.month[int(tm.Month())] {
+		return false
+	}
+	dom := cs.dom[tm.Day()]
+	dow := cs.dow[int(tm.Weekday())]
+	if !cs.domAny && !cs.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
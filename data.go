@@ -11,7 +11,65 @@ type Repo struct {
 	VCS          string `json:"vcs"`           // `git`, `mercurial` or `command`
 	Origin       string `json:"origin"`        // git/mercurial "URL" (as understood by the respective commands), often SSH or HTTPS. if `vcs` is `command`, this is executed using sh.
 	CheckoutPath string `json:"checkout_path"` // path to place the checkout in.
-	BuildScript  string `json:"build_script"`  // shell scripts that compiles the software, runs tests, and creates releasable files.
+	BuildScript  string `json:"build_script"`  // shell scripts that compiles the software, runs tests, and creates releasable files. used as the single step `build` if `steps` is empty.
+
+	Steps []BuildStep `json:"steps"` // steps run in order after cloning, each with its own script. if empty, `build_script` is run as step `build`.
+
+	Cache          bool  `json:"cache"`            // whether builds get a cache dir that is kept between builds, in $CACHEDIR
+	CacheDiskUsage int64 `json:"cache_disk_usage"` // bytes used by the cache dir, updated after each build
+
+	Triggers []Trigger `json:"triggers"` // builds of other repositories to start when a build of a branch succeeds
+
+	PollInterval int      `json:"poll_interval"` // seconds between checking the origin for new commits on branches, for git and mercurial. 0 disables polling.
+	PollInclude  []string `json:"poll_include"`  // patterns for branches to build when polling, as for path.Match. if empty, all branches are included.
+	PollExclude  []string `json:"poll_exclude"`  // patterns for branches not to build when polling, applied after poll_include.
+
+	Matrix []Variant `json:"matrix"` // if not empty, each build starts a build for each variant, with the environment variables of the variant.
+
+	BuildConcurrency int `json:"build_concurrency"` // maximum number of builds for this repository running at the same time. builds for the same branch always run one after the other.
+	CloneTimeout     int `json:"clone_timeout"`     // seconds after which the clone step is aborted, 0 for no timeout.
+	BuildTimeout     int `json:"build_timeout"`     // seconds after which a build step is aborted, 0 for no timeout.
+
+	Limits  Limits `json:"limits"`  // resource limits for build.sh with isolated builds, overriding the limits from the config file.
+	Sandbox *bool  `json:"sandbox"` // whether to run build.sh in a sandbox with isolated builds on linux. if null, the setting from the config file is used.
+
+	IsolateNetwork bool `json:"isolate_network"` // whether build.sh runs without network access, only with a loopback interface. requires isolated builds on linux. the clone step still has network access.
+
+	AgentLabels []string `json:"agent_labels"` // if not empty, builds run on a remote agent (see "ding agent") that has all these labels, eg `os=openbsd` or `arch=arm64`.
+}
+
+// BuildStep is a named step of a build, with the script to run for it.
+type BuildStep struct {
+	Name   string `json:"name"`   // lower case letters, digits, dash and underscore. used as build status while the step is running.
+	Script string `json:"script"` // shell script, run in the checkout directory
+}
+
+// EnvVar is an environment variable for builds of a repository.
+type EnvVar struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`  // empty for secrets when returned through the API
+	Secret bool   `json:"secret"` // secret values can only be written through the API
+}
+
+// Trigger starts builds of other repositories when a build of a branch succeeds.
+type Trigger struct {
+	Branch string   `json:"branch"` // branch of this repository, and the branch built for the other repositories
+	Repos  []string `json:"repos"`  // names of repositories to build
+}
+
+// Variant is an entry in the build matrix of a repository.
+type Variant struct {
+	Name string            `json:"name"` // lower case letters, digits, dash and underscore
+	Env  map[string]string `json:"env"`  // additional environment variables for builds of this variant
+}
+
+// Limits are resource limits for processes started by build.sh. A value of 0 means the default from the config file is used.
+type Limits struct {
+	AddressSpace int64 `json:"address_space"` // bytes of virtual memory per process
+	Processes    int64 `json:"processes"`     // number of processes for the build
+	FileSize     int64 `json:"file_size"`     // bytes, largest file that can be written
+	OpenFiles    int64 `json:"open_files"`    // open files per process
+	CPUSeconds   int64 `json:"cpu_seconds"`   // seconds of cpu time per process
 }
 
 // RepoBuilds is a repository and its most recent build per branch.
@@ -29,6 +87,7 @@ type Result struct {
 	Toolchain string `json:"toolchain"` // string describing the tools used during build, eg SDK version
 	Filename  string `json:"filename"`  // path relative to the checkout directory where build.sh is run
 	Filesize  int64  `json:"filesize"`  // size of filename
+	Sha256    string `json:"sha256"`    // hex-encoded SHA-256 of filename, empty for results of builds from before checksums were recorded
 }
 
 // Build is an attempt at building a repository.
@@ -37,16 +96,26 @@ type Build struct {
 	RepoID          int        `json:"repo_id"`
 	Branch          string     `json:"branch"`
 	CommitHash      string     `json:"commit_hash"` // can be empty until `checkout` step, when building latest version of a branch
-	Status          string     `json:"status"`      // `new`, `clone`, `checkout`, `build`, `success`
+	Status          string     `json:"status"`      // `new`, `clone`, name of a build step, `matrix`, `success`, `cancelled`. if the build failed, the step that failed.
 	Start           time.Time  `json:"start"`
 	Finish          *time.Time `json:"finish"`
 	ErrorMessage    string     `json:"error_message"`
 	Results         []Result   `json:"results"`
 	Released        *time.Time `json:"released"`
+	ReleaseChannel  string     `json:"release_channel"` // eg `stable`, `beta`, `nightly`, empty if not released
+	Yanked          *time.Time `json:"yanked"`          // when the release was withdrawn, null if it wasn't
+	YankReason      string     `json:"yank_reason"`     // why the release was yanked
 	BuilddirRemoved bool       `json:"builddir_removed"`
 
 	LastLine  string `json:"last_line"`  // last line from last steps output
 	DiskUsage int64  `json:"disk_usage"` // disk usage for build
+
+	ParentID    *int    `json:"parent_id"`    // for a variant of a build matrix, the build that started it
+	Variant     string  `json:"variant"`      // name of the variant in the build matrix, empty if not part of a matrix
+	Children    []Build `json:"children"`     // for a build of a repository with a build matrix, a build for each variant. the build has status `matrix` while they run.
+	RetryOf     *int    `json:"retry_of"`     // build that this build retried, if any
+	TriggeredBy *int    `json:"triggered_by"` // build of another repository that triggered this build, if any
+	Scheduled   bool    `json:"scheduled"`    // whether the build was started by a schedule
 }
 
 // Step is one phase of a build and stores the output generated in that step.
@@ -56,11 +125,22 @@ type Step struct {
 	Stderr string `json:"stderr"`
 	Output string `json:"output"` // combined output of stdout and stderr
 	Nsec   int64  `json:"nsec"`   // time it took this step to finish, initially 0
+
+	Sections []Section `json:"sections"` // started by "step:<name>" lines in stdout, in order
+}
+
+// Section is part of the output of a build step, started by a line "step:<name>" on stdout.
+type Section struct {
+	Name  string `json:"name"`
+	Start int64  `json:"start"` // nsec since start of the step
+	Nsec  int64  `json:"nsec"`  // duration of the section, 0 for the last section of a step that is still running
 }
 
 // BuildResult is the stored result of a build, including the build script and step outputs.
 type BuildResult struct {
-	Build       Build  `json:"build"`
-	BuildScript string `json:"build_script"`
-	Steps       []Step `json:"steps"`
+	Build       Build       `json:"build"`
+	BuildScript string      `json:"build_script"` // script for step `build`, empty if the build has no such step
+	Scripts     []BuildStep `json:"scripts"`      // scripts of all build steps, in order
+	Steps       []Step      `json:"steps"`
+	Changelog   *Changelog  `json:"changelog"` // for releases, commits since the previous release. null for builds, and if no changelog could be generated.
 }
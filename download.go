@@ -3,15 +3,19 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func serveDownload(w http.ResponseWriter, r *http.Request) {
@@ -20,8 +24,12 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// /download/{release,result}/<reponame>/<buildid>/<name>.{zip.tgz}
+	// /download/{release,result}/<reponame>/<buildid>/<name>.{zip.tgz}, or /download/release/<reponame>/latest/[<channel>/]<name>.{zip,tgz}
 	t := strings.Split(r.URL.Path[1:], "/")
+	if len(t) >= 5 && t[1] == "release" && t[3] == "latest" && !hasBadElems(t) {
+		redirectLatestRelease(w, r, "download/release/"+t[2], t[2], t[4:], false)
+		return
+	}
 	if len(t) != 5 || hasBadElems(t) {
 		http.NotFound(w, r)
 		return
@@ -49,14 +57,14 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
 		defer rows.Close()
 		files := []archiveFile{}
 		for rows.Next() {
-			var repoCheckoutPath, name string
+			var repoCheckoutPath, name, sha256 string
 			var filesize int64
-			err = rows.Scan(&repoCheckoutPath, &name, &filesize)
+			err = rows.Scan(&repoCheckoutPath, &name, &filesize, &sha256)
 			if err != nil {
 				fail(err)
 				return nil
 			}
-			files = append(files, archiveFile{pathMaker(repoCheckoutPath, name), filesize})
+			files = append(files, archiveFile{pathMaker(repoCheckoutPath, name), filesize, sha256})
 		}
 		if err = rows.Err(); err != nil {
 			fail(err)
@@ -72,7 +80,7 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
 	switch t[1] {
 	case "release":
 		q := `
-			select repo.checkout_path, result.filename, result.filesize
+			select repo.checkout_path, result.filename, result.filesize, result.sha256
 			from result
 			join build on result.build_id = build.id
 			join repo on build.repo_id = repo.id
@@ -80,15 +88,21 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
 			where repo.name=$1 and build.id=$2
 		`
 		files := gatherFiles(q, func(repoCheckoutPath, name string) string {
-			return fmt.Sprintf("data/release/%s/%d/%s", repoName, buildID, path.Base(name))
+			return fmt.Sprintf("%s/%d/%s", repoName, buildID, path.Base(name))
 		})
+		if files == nil {
+			return
+		}
+		if !checkYanked(w, r, repoName, buildID) {
+			return
+		}
+		files = append(files, signatureFiles(files)...)
 		name := t[4]
-		isGzip := true
-		_serveDownload(w, r, name, files, isGzip)
+		_serveDownload(w, r, name, files, releaseStore.Open)
 
 	case "result":
 		q := `
-			select repo.checkout_path, result.filename, result.filesize
+			select repo.checkout_path, result.filename, result.filesize, result.sha256
 			from result
 			join build on result.build_id = build.id
 			join repo on build.repo_id = repo.id
@@ -98,8 +112,10 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
 			return fmt.Sprintf("data/build/%s/%d/checkout/%s/%s", repoName, buildID, repoCheckoutPath, name)
 		})
 		name := t[4]
-		isGzip := false
-		_serveDownload(w, r, name, files, isGzip)
+		_serveDownload(w, r, name, files, func(p string) (io.ReadCloser, bool, error) {
+			f, err := os.Open(p)
+			return f, false, err
+		})
 
 	default:
 		http.NotFound(w, r)
@@ -109,8 +125,50 @@ func serveDownload(w http.ResponseWriter, r *http.Request) {
 }
 
 type archiveFile struct {
-	Path string
-	Size int64
+	Path   string // local path for results, key in the release storage for releases
+	Size   int64
+	Sha256 string // hex, can be empty for old results
+}
+
+// signatureFiles returns the signatures of released files, for those that have one.
+func signatureFiles(files []archiveFile) []archiveFile {
+	l := []archiveFile{}
+	for _, f := range files {
+		p := f.Path + ".minisig"
+		n, err := func() (int64, error) {
+			rc, gzipped, err := releaseStore.Open(p)
+			if err != nil {
+				return 0, err
+			}
+			defer rc.Close()
+			var r io.Reader = rc
+			if gzipped {
+				if r, err = gzip.NewReader(rc); err != nil {
+					return 0, err
+				}
+			}
+			return io.Copy(ioutil.Discard, r)
+		}()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Printf("download: reading signature %s: %s\n", p, err)
+			continue
+		}
+		l = append(l, archiveFile{p, n, ""})
+	}
+	return l
+}
+
+// sha256Sums returns the contents of a SHA256SUMS file for the files, in the format of sha256sum.
+func sha256Sums(files []archiveFile) []byte {
+	var b bytes.Buffer
+	for _, f := range files {
+		if f.Sha256 != "" {
+			fmt.Fprintf(&b, "%s  %s\n", f.Sha256, path.Base(f.Path))
+		}
+	}
+	return b.Bytes()
 }
 
 // we have .gz on disk.  gzip is a deflate stream with a header and a footer.
@@ -241,27 +299,28 @@ func newGzipStrippingDeflateWriter(w io.Writer) (io.WriteCloser, error) {
 	return &gzipStrippingDeflateWriter{w: w}, nil
 }
 
-// `files` do not have the .gz suffix they have in the file system.
-func _serveDownload(w http.ResponseWriter, r *http.Request, name string, files []archiveFile, isGzip bool) {
+// open returns the contents of a file, and whether they are gzipped.
+func _serveDownload(w http.ResponseWriter, r *http.Request, name string, files []archiveFile, open func(path string) (io.ReadCloser, bool, error)) {
 	if strings.HasSuffix(name, ".zip") {
 		base := strings.TrimSuffix(name, ".zip")
 		w.Header().Set("Content-Type", "application/zip")
 		zw := zip.NewWriter(w)
-		if isGzip {
-			zw.RegisterCompressor(zip.Deflate, newGzipStrippingDeflateWriter)
-		}
 
 		addFile := func(file archiveFile) bool {
-			lpath := file.Path
-			if isGzip {
-				lpath += ".gz"
-			}
-			f, err := os.Open(lpath)
+			f, isGzip, err := open(file.Path)
 			if err != nil {
-				log.Printf("download: open %s to add to zip: %s\n", lpath, err)
+				log.Printf("download: open %s to add to zip: %s\n", file.Path, err)
 				return false
 			}
 			defer f.Close()
+			// compressors are looked up when a file is added
+			if isGzip {
+				zw.RegisterCompressor(zip.Deflate, newGzipStrippingDeflateWriter)
+			} else {
+				zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+					return flate.NewWriter(w, flate.DefaultCompression)
+				})
+			}
 
 			filename := path.Base(file.Path)
 			fw, err := zw.Create(base + "/" + filename)
@@ -277,11 +336,22 @@ func _serveDownload(w http.ResponseWriter, r *http.Request, name string, files [
 			}
 			return true
 		}
+		ok := true
 		for _, path := range files {
 			if !addFile(path) {
+				ok = false
 				break
 			}
 		}
+		if sums := sha256Sums(files); ok && len(sums) > 0 {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: base + "/SHA256SUMS", Method: zip.Store})
+			if err == nil {
+				_, err = fw.Write(sums)
+			}
+			if err != nil {
+				log.Printf("download: adding SHA256SUMS to zip: %s\n", err)
+			}
+		}
 		// errors would probably be closed connections
 		err := zw.Close()
 		if err != nil {
@@ -293,35 +363,38 @@ func _serveDownload(w http.ResponseWriter, r *http.Request, name string, files [
 		tw := tar.NewWriter(gzw)
 
 		addFile := func(file archiveFile) bool {
-			lpath := file.Path
-			if isGzip {
-				lpath += ".gz"
-			}
-			f, err := os.Open(lpath)
+			f, isGzip, err := open(file.Path)
 			if err != nil {
-				log.Printf("download: open %s to add to tgz: %s\n", lpath, err)
+				log.Printf("download: open %s to add to tgz: %s\n", file.Path, err)
 				return false
 			}
 			defer f.Close()
-			fi, err := f.Stat()
-			if err != nil {
-				log.Printf("download: stat %s to add to tgz: %s\n", lpath, err)
-				return false
+			// files from object storage have no file system metadata
+			mode := int64(0644)
+			modTime := time.Now()
+			if lf, ok := f.(*os.File); ok {
+				fi, err := lf.Stat()
+				if err != nil {
+					log.Printf("download: stat %s to add to tgz: %s\n", file.Path, err)
+					return false
+				}
+				mode = int64(fi.Mode().Perm())
+				modTime = fi.ModTime()
 			}
 			var gzr io.Reader = f
 			if isGzip {
 				gzr, err = gzip.NewReader(f)
 				if err != nil {
-					log.Printf("download: reading gzip %s: %s\n", lpath, err)
+					log.Printf("download: reading gzip %s: %s\n", file.Path, err)
 					return false
 				}
 			}
 
 			hdr := &tar.Header{
 				Name:     base + "/" + path.Base(file.Path),
-				Mode:     int64(fi.Mode().Perm()),
+				Mode:     mode,
 				Size:     file.Size,
-				ModTime:  fi.ModTime(),
+				ModTime:  modTime,
 				Typeflag: tar.TypeReg,
 			}
 			err = tw.WriteHeader(hdr)
@@ -336,11 +409,29 @@ func _serveDownload(w http.ResponseWriter, r *http.Request, name string, files [
 			}
 			return true
 		}
+		ok := true
 		for _, path := range files {
 			if !addFile(path) {
+				ok = false
 				break
 			}
 		}
+		if sums := sha256Sums(files); ok && len(sums) > 0 {
+			hdr := &tar.Header{
+				Name:     base + "/SHA256SUMS",
+				Mode:     0644,
+				Size:     int64(len(sums)),
+				ModTime:  time.Now(),
+				Typeflag: tar.TypeReg,
+			}
+			err := tw.WriteHeader(hdr)
+			if err == nil {
+				_, err = tw.Write(sums)
+			}
+			if err != nil {
+				log.Printf("download: adding SHA256SUMS to tgz: %s\n", err)
+			}
+		}
 		// errors would probably be closed connections
 		tw.Close()
 		gzw.Close()
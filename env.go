@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// environment variables set by ding for each build, they cannot be overridden per repository
+var builtinEnv = []string{"BUILDDIR", "CHECKOUTPATH", "HOME", "BUILDID", "REPONAME", "BRANCH", "COMMIT", "STEP", "VARIANT", "CACHEDIR"}
+
+// mergeEnv returns the environment for a build as "key=value" strings, sorted by key.
+// Each key is present once, with the value from the last map that has it.
+func mergeEnv(maps ...map[string]string) []string {
+	vars := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			vars[k] = v
+		}
+	}
+	keys := []string{}
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := []string{}
+	for _, k := range keys {
+		env = append(env, k+"="+vars[k])
+	}
+	return env
+}
+
+// envMap parses "key=value" strings, as returned by os.Environ, later values taking precedence.
+func envMap(env []string) map[string]string {
+	m := map[string]string{}
+	for _, s := range env {
+		t := strings.SplitN(s, "=", 2)
+		if len(t) == 2 {
+			m[t[0]] = t[1]
+		}
+	}
+	return m
+}
+
+// _repoEnv returns the environment variables of a repository, including the values of secrets.
+func _repoEnv(tx *sql.Tx, repoID int) (vars []EnvVar) {
+	q := `select coalesce(json_agg(x.* order by x.key), '[]') from (select key, value, secret from repo_env where repo_id=$1) x`
+	sherpaCheckRow(tx.QueryRow(q, repoID), &vars, "fetching environment variables")
+	return
+}
+
+func _checkEnvKey(key string) {
+	if !envNameRegexp.MatchString(key) {
+		userError(fmt.Sprintf("Invalid environment variable name %q.", key))
+	}
+	for _, s := range builtinEnv {
+		if s == key {
+			userError(fmt.Sprintf("Environment variable %s is set by ding, it cannot be configured.", key))
+		}
+	}
+}
+
+// RepoEnv returns the environment variables configured for builds of a repository.
+// The values of secrets are never returned, they are empty.
+func (Ding) RepoEnv(repoName string) (vars []EnvVar) {
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		vars = _repoEnv(tx, repo.ID)
+	})
+	for i := range vars {
+		if vars[i].Secret {
+			vars[i].Value = ""
+		}
+	}
+	return
+}
+
+// SetRepoEnv adds or replaces an environment variable for builds of a repository.
+// Secrets can only be written, they are never returned through the API.
+func (Ding) SetRepoEnv(repoName, key, value string, secret bool) {
+	_checkEnvKey(key)
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		result, err := tx.Exec(`update repo_env set value=$1, secret=$2 where repo_id=$3 and key=$4`, value, secret, repo.ID, key)
+		sherpaCheck(err, "updating environment variable in database")
+		n, err := result.RowsAffected()
+		sherpaCheck(err, "checking for updated environment variable")
+		if n == 0 {
+			_, err = tx.Exec(`insert into repo_env (repo_id, key, value, secret) values ($1, $2, $3, $4)`, repo.ID, key, value, secret)
+			sherpaCheck(err, "inserting environment variable in database")
+		}
+	})
+}
+
+// RemoveRepoEnv removes an environment variable from a repository.
+func (Ding) RemoveRepoEnv(repoName, key string) {
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		var id int
+		sherpaCheckRow(tx.QueryRow(`delete from repo_env where repo_id=$1 and key=$2 returning id`, repo.ID, key), &id, "removing environment variable from database")
+	})
+}
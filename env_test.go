@@ -0,0 +1,17 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	global := map[string]string{"GOFLAGS": "-mod=vendor", "GLOBAL": "1"}
+	repo := envMap([]string{"GOFLAGS=-mod=mod", "REPO=a=b", "invalid"})
+	builtin := map[string]string{"HOME": "/build/home"}
+	env := mergeEnv(global, repo, nil, builtin)
+	exp := []string{"GLOBAL=1", "GOFLAGS=-mod=mod", "HOME=/build/home", "REPO=a=b"}
+	if !reflect.DeepEqual(env, exp) {
+		t.Fatalf("got %q, expected %q", env, exp)
+	}
+}
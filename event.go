@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type eventStringer interface {
@@ -51,6 +52,32 @@ func (e EventRemoveBuild) eventString() (string, []byte, error) {
 	return "removeBuild", buf, err
 }
 
+// EventEnqueue represents a build being added to the queue, waiting for its turn to run.
+type EventEnqueue struct {
+	RepoName string    `json:"repo_name"`
+	BuildID  int       `json:"build_id"`
+	Branch   string    `json:"branch"`
+	Variant  string    `json:"variant"`
+	Queued   time.Time `json:"queued"`
+}
+
+func (e EventEnqueue) eventString() (string, []byte, error) {
+	buf, err := json.Marshal(e)
+	return "enqueue", buf, err
+}
+
+// EventDequeue represents a build leaving the queue.
+type EventDequeue struct {
+	RepoName string `json:"repo_name"`
+	BuildID  int    `json:"build_id"`
+	Reason   string `json:"reason"` // `started` or `cancelled`
+}
+
+func (e EventDequeue) eventString() (string, []byte, error) {
+	buf, err := json.Marshal(e)
+	return "dequeue", buf, err
+}
+
 // EventOutput represents new output from a build.
 // Text only contains the newly added output, not the full output so far.
 type EventOutput struct {
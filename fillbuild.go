@@ -13,7 +13,7 @@ func fillBuild(repoName string, b *Build) {
 		b.DiskUsage = buildDiskUsage(buildDir)
 	}
 
-	if b.Finish == nil || b.Status == "success" {
+	if b.Finish == nil || b.Status == "success" || b.Status == "cancelled" || b.Status == "matrix" || b.Status == "failed" {
 		return
 	}
 	path := fmt.Sprintf("data/build/%s/%d/output/%s.output", repoName, b.ID, b.Status)
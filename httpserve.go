@@ -13,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 
@@ -22,16 +23,6 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-type job struct {
-	repoName string
-	rc       chan struct{}
-}
-
-var (
-	newJobs      chan job
-	finishedJobs chan string // repoName
-)
-
 func servehttp(args []string) {
 	log.SetFlags(0)
 	log.SetPrefix("http-serve: ")
@@ -51,6 +42,8 @@ func servehttp(args []string) {
 	dec := gob.NewDecoder(msgfile)
 	err := dec.Decode(&config)
 	check(err, "reading config")
+	loadSigningKey()
+	initReleaseStorage()
 
 	// be cautious
 	if config.IsolateBuilds.Enabled && (os.Getuid() != config.IsolateBuilds.DingUID || os.Getgid() != config.IsolateBuilds.DingGID) {
@@ -103,6 +96,9 @@ func servehttp(args []string) {
 	http.HandleFunc("/result/", serveResult)
 	http.HandleFunc("/download/", serveDownload)
 	http.HandleFunc("/events", serveEvents)
+	http.HandleFunc("/agent/", serveAgent)
+	http.HandleFunc("/release.pub", serveSigningKey)
+	http.HandleFunc("/changelog/", serveChangelog)
 
 	go eventMux()
 
@@ -110,37 +106,11 @@ func servehttp(args []string) {
 	check(err, "getting current work dir")
 
 	newJobs = make(chan job, 1)
-	finishedJobs = make(chan string, 1)
-	go func() {
-		active := map[string]struct{}{}
-		pending := map[string][]job{}
-
-		kick := func(repoName string) {
-			if _, ok := active[repoName]; ok {
-				return
-			}
-			jobs := pending[repoName]
-			if len(jobs) == 0 {
-				return
-			}
-			job := jobs[0]
-			pending[repoName] = jobs[1:]
-			active[repoName] = struct{}{}
-			job.rc <- struct{}{}
-		}
-
-		for {
-			select {
-			case job := <-newJobs:
-				pending[job.repoName] = append(pending[job.repoName], job)
-				kick(job.repoName)
-
-			case repoName := <-finishedJobs:
-				delete(active, repoName)
-				kick(repoName)
-			}
-		}
-	}()
+	finishedJobs = make(chan job, 1)
+	cancelJobs = make(chan cancelJob)
+	moveJobs = make(chan moveJob)
+	queueJobs = make(chan chan []QueueJob)
+	go scheduleJobs()
 
 	unfinishedMsg := "marked as failed/unfinished at ding startup."
 	qStale := `
@@ -180,24 +150,19 @@ func servehttp(args []string) {
 	`
 	checkRow(database.QueryRow(qnew), &newBuilds, "fetching new builds from database")
 	for _, repoBuild := range newBuilds {
-		func(repo Repo, build Build) {
-			job := job{
-				repo.Name,
-				make(chan struct{}),
-			}
-			newJobs <- job
-			go func() {
-				<-job.rc
-				defer func() {
-					finishedJobs <- job.repoName
-				}()
-
-				buildDir := fmt.Sprintf("%s/data/build/%s/%d", dingWorkDir, repo.Name, build.ID)
-				_doBuild(repo, build, buildDir)
-			}()
-		}(repoBuild.Repo, repoBuild.Build)
+		repo, build := repoBuild.Repo, repoBuild.Build
+		buildDir := fmt.Sprintf("%s/data/build/%s/%d", dingWorkDir, repo.Name, build.ID)
+		if build.ParentID == nil && len(repo.Matrix) > 0 {
+			go doMatrixBuild(repo, build, buildDir)
+			continue
+		}
+		job := enqueueJob(repo, build)
+		go runJob(job, repo, build, buildDir)
 	}
 
+	go scheduleBuilds()
+	go pollOrigins()
+
 	if *listenWebhookAddress != "" {
 		log.Printf("ding version %s, listening on %s and for webhooks on %s\n", version, *listenAddress, *listenWebhookAddress)
 		webhookHandler := http.NewServeMux()
@@ -225,7 +190,7 @@ func servehttp(args []string) {
 		check(err, "reading response from root")
 
 		switch req.msg.Kind {
-		case msgChown, msgRemovedir:
+		case msgChown, msgRemovedir, msgCancel:
 			var err error
 			if r != "" {
 				err = fmt.Errorf("%s", r)
@@ -240,34 +205,45 @@ func servehttp(args []string) {
 				continue
 			}
 
-			buf := make([]byte, 1)   // nothing in there
-			oob := make([]byte, 128) // expect 3*24 bytes
-			_, oobn, _, _, err := unixconn.ReadMsgUnix(buf, oob)
-			check(err, "receiving fd")
-			scms, err := unix.ParseSocketControlMessage(oob[:oobn])
-			check(err, "parsing control message")
-			if len(scms) != 1 {
-				log.Fatalln("client: expected 1 SocketControlMessage; got scms =", scms)
-			}
-
-			fds, err := unix.ParseUnixRights(&scms[0])
-			check(err, "parse unix rights")
-			if len(fds) != 3 {
-				log.Fatalf("wanted 3 fds; got %d fds\n", len(fds))
-			}
-
+			fds := receiveFDs(unixconn, 3)
 			stdout := os.NewFile(uintptr(fds[0]), fmt.Sprintf("build-%d-stdout", req.msg.BuildID))
 			stderr := os.NewFile(uintptr(fds[1]), fmt.Sprintf("build-%d-stderr", req.msg.BuildID))
 			status := os.NewFile(uintptr(fds[2]), fmt.Sprintf("build-%d-status", req.msg.BuildID))
 
 			req.buildResponse <- buildResult{nil, stdout, stderr, status}
 
+		case msgRemoveCache, msgRestoreCache, msgSaveCache:
+			// the root process does the work in the background, and sends a status fd for the result
+			fds := receiveFDs(unixconn, 1)
+			status := os.NewFile(uintptr(fds[0]), fmt.Sprintf("cache-%s-%d-status", req.msg.RepoName, req.msg.BuildID))
+			req.buildResponse <- buildResult{nil, nil, nil, status}
+
 		default:
 			log.Fatalf("unknown msg.kind %d\n", req.msg.Kind)
 		}
 	}
 }
 
+// receiveFDs reads a message from the root process with n file descriptors.
+func receiveFDs(unixconn *net.UnixConn, n int) []int {
+	buf := make([]byte, 1)   // nothing in there
+	oob := make([]byte, 128) // expect 3*24 bytes
+	_, oobn, _, _, err := unixconn.ReadMsgUnix(buf, oob)
+	check(err, "receiving fd")
+	scms, err := unix.ParseSocketControlMessage(oob[:oobn])
+	check(err, "parsing control message")
+	if len(scms) != 1 {
+		log.Fatalln("client: expected 1 SocketControlMessage; got scms =", scms)
+	}
+
+	fds, err := unix.ParseUnixRights(&scms[0])
+	check(err, "parse unix rights")
+	if len(fds) != n {
+		log.Fatalf("wanted %d fds; got %d fds\n", n, len(fds))
+	}
+	return fds
+}
+
 func serveAsset(w http.ResponseWriter, r *http.Request) {
 	if strings.HasSuffix(r.URL.Path, "/") {
 		r.URL.Path += "index.html"
@@ -316,36 +292,69 @@ func hasBadElems(elems []string) bool {
 }
 
 func serveRelease(w http.ResponseWriter, r *http.Request) {
+	// /release/<reponame>/<buildid>/<name>, or /release/<reponame>/latest/[<channel>/]<name>
+	t := strings.Split(r.URL.Path[1:], "/")
+	if r.Method == "DELETE" && len(t) == 3 && !hasBadElems(t[1:]) {
+		purgeRelease(w, r, t[1], t[2])
+		return
+	}
 	if r.Method != "GET" {
 		http.Error(w, "bad method", 405)
 		return
 	}
-	t := strings.Split(r.URL.Path[1:], "/")
+	if len(t) >= 4 && t[2] == "latest" && !hasBadElems(t[1:]) {
+		redirectLatestRelease(w, r, "release/"+t[1], t[1], t[3:], true)
+		return
+	}
 	if len(t) != 4 || hasBadElems(t[1:]) {
 		http.NotFound(w, r)
 		return
 	}
 
+	buildID, err := strconv.Atoi(t[2])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkYanked(w, r, t[1], buildID) {
+		return
+	}
+
 	name := t[3]
-	path := fmt.Sprintf("data/release/%s/%s/%s.gz", t[1], t[2], name)
-	f, err := os.Open(path)
+	key := fmt.Sprintf("%s/%d/%s", t[1], buildID, name)
+	// also set for redirects to object storage, which does not know the checksum
+	if sum := releaseSha256(t[1], t[2], name); sum != "" {
+		w.Header().Set(checksumHeader, sum)
+	}
+	if u, err := releaseStore.URL(key); err != nil {
+		log.Printf("release: url for %s: %s\n", key, err)
+		http.Error(w, "server error", 500)
+		return
+	} else if u != "" {
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+	f, gzipped, err := releaseStore.Open(key)
 	if err != nil {
 		if os.IsNotExist(err) {
 			http.NotFound(w, r)
 			return
 		}
+		log.Printf("release: open %s: %s\n", key, err)
 		http.Error(w, "server error", 500)
 		return
 	}
 	defer f.Close()
 
-	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+	if !gzipped {
+		io.Copy(w, f) // nothing to do for errors
+	} else if acceptsGzip(r.Header.Get("Accept-Encoding")) {
 		w.Header().Set("Content-Encoding", "gzip")
 		io.Copy(w, f) // nothing to do for errors
 	} else {
 		gzr, err := gzip.NewReader(f)
 		if err != nil {
-			log.Printf("release: reading gzip file %s: %s\n", path, err)
+			log.Printf("release: reading gzip file %s: %s\n", key, err)
 			http.Error(w, "server error", 500)
 			return
 		}
@@ -353,6 +362,42 @@ func serveRelease(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// response header with the hex-encoded SHA-256 of a downloaded release or result file
+const checksumHeader = "X-Checksum-Sha256"
+
+// releaseSha256 returns the SHA-256 of a released file, or the empty string if it isn't known.
+func releaseSha256(repoName, buildID, name string) string {
+	id, err := strconv.Atoi(buildID)
+	if err != nil {
+		return ""
+	}
+	q := `
+		select result.filename, result.sha256
+		from result
+		join build on result.build_id = build.id
+		join repo on build.repo_id = repo.id
+		join release on build.id = release.build_id
+		where repo.name=$1 and build.id=$2
+	`
+	rows, err := database.Query(q, repoName, id)
+	if err != nil {
+		log.Printf("release: fetching checksum: %s\n", err)
+		return ""
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filename, sha256 string
+		if err := rows.Scan(&filename, &sha256); err != nil {
+			log.Printf("release: fetching checksum: %s\n", err)
+			return ""
+		}
+		if path.Base(filename) == name {
+			return sha256
+		}
+	}
+	return ""
+}
+
 func acceptsGzip(s string) bool {
 	t := strings.Split(s, ",")
 	for _, e := range t {
@@ -392,7 +437,7 @@ func serveResult(w http.ResponseWriter, r *http.Request) {
 	}
 
 	q := `
-		select repo.checkout_path, result.filename
+		select repo.checkout_path, result.filename, result.sha256
 		from result
 		join build on result.build_id = build.id
 		join repo on build.repo_id = repo.id
@@ -405,13 +450,16 @@ func serveResult(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var repoCheckoutPath, name string
-		err = rows.Scan(&repoCheckoutPath, &name)
+		var repoCheckoutPath, name, sha256 string
+		err = rows.Scan(&repoCheckoutPath, &name, &sha256)
 		if err != nil {
 			fail(err)
 			return
 		}
 		if strings.HasSuffix(name, "/"+basename) {
+			if sha256 != "" {
+				w.Header().Set(checksumHeader, sha256)
+			}
 			path := fmt.Sprintf("data/build/%s/%d/checkout/%s/%s", repoName, buildID, repoCheckoutPath, name)
 			http.ServeFile(w, r, path)
 			return
@@ -8,18 +8,28 @@ import (
 type msg struct {
 	Kind msgKind
 
-	RepoName     string
-	BuildID      int
-	CheckoutPath string   // for the workdir of the build command
-	Env          []string // environment when building
+	RepoName       string
+	BuildID        int
+	CheckoutPath   string   // for the workdir of the build command
+	Step           string   // name of build step, its script is run
+	Cache          bool     // whether the build has a copy of the cache dir of the repo, to chown
+	Env            []string // environment when building
+	Timeout        int      // seconds after which build.sh is killed, 0 for no timeout
+	Limits         Limits   // resource limits for build.sh, 0 for no limit
+	Sandbox        bool     // whether to run build.sh in new namespaces with a mostly read-only file system
+	IsolateNetwork bool     // whether to run build.sh in a new network namespace, with only loopback
 }
 
 type msgKind int
 
 const (
-	msgChown     = msgKind(iota) // chown the homedir & checkoutdir of a build
-	msgRemovedir                 // remove a builddir, or (if buildId < 0), an entire repo
-	msgBuild                     // start a build by running build.sh
+	msgChown        = msgKind(iota) // chown the homedir & checkoutdir of a build
+	msgRemovedir                    // remove a builddir, or (if buildId < 0), an entire repo
+	msgBuild                        // start a build step by running its script
+	msgCancel                       // kill the process group of a running build step
+	msgRemoveCache                  // remove the cache dir of a repo, or (if buildId > 0) the copy of a build
+	msgRestoreCache                 // copy the cache dir of a repo into a builddir, in the background like the other cache msgs
+	msgSaveCache                    // replace the cache dir of a repo with the copy of a build
 )
 
 // request from one of the http handlers to httpserve's request mux
@@ -29,7 +39,7 @@ type request struct {
 	buildResponse chan buildResult
 }
 
-// result of starting a build
+// result of starting a build, or of a cache msg, which only has a status
 type buildResult struct {
 	err    error // if non-nil, quick failure.  otherwise, the files below will send updates
 	stdout *os.File
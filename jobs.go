@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+const cancelledMsg = "Build cancelled."
+
+type job struct {
+	repoName    string
+	branch      string
+	variant     string // of build matrix, builds of different variants of a branch can run at the same time
+	buildID     int
+	concurrency int       // max concurrent builds for the repository
+	rc          chan bool // receives true when the job can start, false if it was cancelled while pending
+	queued      time.Time
+	started     time.Time // zero while pending
+	agent       bool      // runs on a remote agent, not limited by config.MaxBuilds
+}
+
+// request to remove a pending job from the queue
+type cancelJob struct {
+	buildID int
+	rc      chan bool // whether the job was pending and has been removed
+}
+
+// request to move a pending job to the front of the queue
+type moveJob struct {
+	buildID int
+	rc      chan bool // whether the job was pending and has been moved
+}
+
+type repoBranch struct {
+	repoName string
+	branch   string
+	variant  string
+}
+
+var (
+	newJobs      chan job
+	finishedJobs chan job
+	cancelJobs   chan cancelJob
+	moveJobs     chan moveJob
+	queueJobs    chan chan []QueueJob // for listing queued and running jobs
+)
+
+// enqueueJob registers the build as active and adds it to the queue.
+func enqueueJob(repo Repo, build Build) job {
+	job := job{
+		repo.Name,
+		build.Branch,
+		build.Variant,
+		build.ID,
+		repo.BuildConcurrency,
+		make(chan bool),
+		time.Now(),
+		time.Time{},
+		len(repo.AgentLabels) > 0,
+	}
+	registerBuild(build.ID)
+	newJobs <- job
+	return job
+}
+
+// scheduleJobs starts jobs, up to config.MaxBuilds at a time, and for each repository up to its build concurrency.
+// Builds for the same repository and branch never run at the same time.
+// Repositories with pending jobs take turns, so a burst of builds for one repository does not starve the others.
+func scheduleJobs() {
+	active := 0 // local jobs only
+	activeRepos := map[string]int{}
+	activeBranches := map[repoBranch]struct{}{}
+	pending := map[string][]job{}
+	order := []string{}      // repositories with pending jobs, next turn first
+	running := map[int]job{} // by build id
+
+	runnable := func(j job) bool {
+		concurrency := j.concurrency
+		if concurrency <= 0 {
+			concurrency = 1
+		}
+		if activeRepos[j.repoName] >= concurrency {
+			return false
+		}
+		if !j.agent && config.MaxBuilds > 0 && active >= config.MaxBuilds {
+			return false
+		}
+		_, ok := activeBranches[repoBranch{j.repoName, j.branch, j.variant}]
+		return !ok
+	}
+
+	// start the next runnable job, returning whether one was started
+	next := func() bool {
+		for i, repoName := range order {
+			jobs := pending[repoName]
+			for k, j := range jobs {
+				if !runnable(j) {
+					continue
+				}
+				jobs = append(jobs[:k:k], jobs[k+1:]...)
+				order = append(order[:i:i], order[i+1:]...)
+				if len(jobs) == 0 {
+					delete(pending, repoName)
+				} else {
+					pending[repoName] = jobs
+					order = append(order, repoName)
+				}
+
+				if !j.agent {
+					active++
+				}
+				activeRepos[j.repoName]++
+				activeBranches[repoBranch{j.repoName, j.branch, j.variant}] = struct{}{}
+				j.started = time.Now()
+				running[j.buildID] = j
+				events <- EventDequeue{j.repoName, j.buildID, "started"}
+				j.rc <- true
+				return true
+			}
+		}
+		return false
+	}
+
+	kick := func() {
+		for next() {
+		}
+	}
+
+	// why a pending job cannot start yet
+	waiting := func(j job) string {
+		if _, ok := activeBranches[repoBranch{j.repoName, j.branch, j.variant}]; ok {
+			return "A build of the same branch is running."
+		}
+		if !j.agent && config.MaxBuilds > 0 && active >= config.MaxBuilds {
+			return "Maximum number of concurrent builds reached."
+		}
+		if !runnable(j) {
+			return "Build concurrency of the repository reached."
+		}
+		return "Waiting for its turn."
+	}
+
+	queue := func() []QueueJob {
+		now := time.Now()
+		l := []QueueJob{}
+		for _, j := range running {
+			started := j.started
+			l = append(l, QueueJob{
+				RepoName:    j.repoName,
+				BuildID:     j.buildID,
+				Branch:      j.branch,
+				Variant:     j.variant,
+				Running:     true,
+				Queued:      j.queued,
+				Started:     &started,
+				WaitSeconds: int64(started.Sub(j.queued) / time.Second),
+			})
+		}
+		sort.Slice(l, func(i, k int) bool {
+			return l[i].Started.Before(*l[k].Started)
+		})
+		// pending jobs in the order they would start if they were all runnable: repositories take turns
+		index := map[string]int{}
+		position := 0
+		for more := true; more; {
+			more = false
+			for _, repoName := range order {
+				jobs := pending[repoName]
+				i := index[repoName]
+				if i >= len(jobs) {
+					continue
+				}
+				more = true
+				index[repoName]++
+				position++
+				j := jobs[i]
+				l = append(l, QueueJob{
+					RepoName:    j.repoName,
+					BuildID:     j.buildID,
+					Branch:      j.branch,
+					Variant:     j.variant,
+					Position:    position,
+					Queued:      j.queued,
+					WaitSeconds: int64(now.Sub(j.queued) / time.Second),
+					Waiting:     waiting(j),
+				})
+			}
+		}
+		return l
+	}
+
+	for {
+		select {
+		case j := <-newJobs:
+			if _, ok := pending[j.repoName]; !ok {
+				order = append(order, j.repoName)
+			}
+			pending[j.repoName] = append(pending[j.repoName], j)
+			events <- EventEnqueue{j.repoName, j.buildID, j.branch, j.variant, j.queued}
+			kick()
+
+		case j := <-finishedJobs:
+			delete(running, j.buildID)
+			if !j.agent {
+				active--
+			}
+			activeRepos[j.repoName]--
+			if activeRepos[j.repoName] == 0 {
+				delete(activeRepos, j.repoName)
+			}
+			delete(activeBranches, repoBranch{j.repoName, j.branch, j.variant})
+			kick()
+
+		case c := <-cancelJobs:
+			found := false
+			for repoName, jobs := range pending {
+				for k, j := range jobs {
+					if j.buildID != c.buildID {
+						continue
+					}
+					jobs = append(jobs[:k:k], jobs[k+1:]...)
+					if len(jobs) > 0 {
+						pending[repoName] = jobs
+					} else {
+						delete(pending, repoName)
+						for i, name := range order {
+							if name == repoName {
+								order = append(order[:i:i], order[i+1:]...)
+								break
+							}
+						}
+					}
+					events <- EventDequeue{j.repoName, j.buildID, "cancelled"}
+					j.rc <- false
+					found = true
+					break
+				}
+				if found {
+					break
+				}
+			}
+			c.rc <- found
+
+		case m := <-moveJobs:
+			found := false
+			for repoName, jobs := range pending {
+				for k, j := range jobs {
+					if j.buildID != m.buildID {
+						continue
+					}
+					pending[repoName] = append([]job{j}, append(jobs[:k:k], jobs[k+1:]...)...)
+					for i, name := range order {
+						if name == repoName {
+							order = append([]string{repoName}, append(order[:i:i], order[i+1:]...)...)
+							break
+						}
+					}
+					found = true
+					break
+				}
+				if found {
+					break
+				}
+			}
+			m.rc <- found
+
+		case rc := <-queueJobs:
+			rc <- queue()
+		}
+	}
+}
+
+// runJob waits for its turn to run the build, then runs it.
+// If the job is cancelled while waiting, the build is marked as cancelled.
+func runJob(job job, repo Repo, build Build, buildDir string) {
+	defer unregisterBuild(build.ID)
+	if !<-job.rc {
+		_markCancelled(repo.Name, build.ID)
+		return
+	}
+	defer func() {
+		finishedJobs <- job
+	}()
+	_doBuild(repo, build, buildDir)
+}
+
+func _markCancelled(repoName string, buildID int) {
+	transact(func(tx *sql.Tx) {
+		q := `update build set status='cancelled', finish=NOW(), error_message=$1 where id=$2 returning id`
+		err := tx.QueryRow(q, cancelledMsg, buildID).Scan(&buildID)
+		sherpaCheck(err, "marking build as cancelled in database")
+		events <- EventBuild{repoName, _build(tx, repoName, buildID)}
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// buildLimits returns the resource limits for build.sh of a repository: the limits set for the repository, with defaults from the config file.
+func buildLimits(repo Repo) Limits {
+	if !config.IsolateBuilds.Enabled {
+		return Limits{}
+	}
+	pick := func(v, def int64) int64 {
+		if v > 0 {
+			return v
+		}
+		return def
+	}
+	c := config.IsolateBuilds.Limits
+	l := repo.Limits
+	return Limits{
+		AddressSpace: pick(l.AddressSpace, c.AddressSpace),
+		Processes:    pick(l.Processes, c.Processes),
+		FileSize:     pick(l.FileSize, c.FileSize),
+		OpenFiles:    pick(l.OpenFiles, c.OpenFiles),
+		CPUSeconds:   pick(l.CPUSeconds, c.CPUSeconds),
+	}
+}
+
+// buildSandbox returns whether build.sh of a repository runs in a sandbox.
+func buildSandbox(repo Repo) bool {
+	if !config.IsolateBuilds.Enabled {
+		return false
+	}
+	if repo.Sandbox != nil {
+		return *repo.Sandbox
+	}
+	return config.IsolateBuilds.Sandbox
+}
+
+func (l Limits) isZero() bool {
+	return l == Limits{}
+}
+
+// command-line arguments for "ding build-exec"
+func (l Limits) args() []string {
+	return []string{
+		fmt.Sprintf("-as=%d", l.AddressSpace),
+		fmt.Sprintf("-nproc=%d", l.Processes),
+		fmt.Sprintf("-fsize=%d", l.FileSize),
+		fmt.Sprintf("-nofile=%d", l.OpenFiles),
+		fmt.Sprintf("-cpu=%d", l.CPUSeconds),
+	}
+}
+
+// limitSignal describes a reached resource limit based on the signal that terminated build.sh, or returns an empty string.
+func limitSignal(l Limits, sig syscall.Signal) string {
+	switch {
+	case sig == syscall.SIGXCPU && l.CPUSeconds > 0:
+		return fmt.Sprintf("cpu time limit of %d seconds reached", l.CPUSeconds)
+	case sig == syscall.SIGXFSZ && l.FileSize > 0:
+		return fmt.Sprintf("file size limit of %d bytes reached", l.FileSize)
+	}
+	return ""
+}
+
+// limitHint describes the resource limit that was probably reached, based on the output of a failed build.sh, or returns an empty string.
+func limitHint(l Limits, output string) string {
+	hints := []struct {
+		limit    int64
+		messages []string
+		format   string
+	}{
+		{l.CPUSeconds, []string{"CPU time limit exceeded"}, "cpu time limit of %d seconds reached"},
+		{l.FileSize, []string{"File size limit exceeded"}, "file size limit of %d bytes reached"},
+		{l.Processes, []string{"Resource temporarily unavailable", "Cannot fork", "fork: retry"}, "process limit of %d probably reached"},
+		{l.OpenFiles, []string{"Too many open files"}, "open files limit of %d probably reached"},
+		{l.AddressSpace, []string{"Cannot allocate memory", "out of memory", "memory exhausted"}, "address space limit of %d bytes probably reached"},
+	}
+	for _, h := range hints {
+		if h.limit <= 0 {
+			continue
+		}
+		for _, m := range h.messages {
+			if strings.Contains(output, m) {
+				return fmt.Sprintf(h.format, h.limit)
+			}
+		}
+	}
+	return ""
+}
@@ -5,6 +5,11 @@ import (
 )
 
 func _sendMailFailing(repo Repo, build Build, errmsg string) {
+	// output and error message can quote secrets, eg in commands that failed
+	masker := _repoMasker(repo)
+	build.LastLine = masker.mask(build.LastLine)
+	errmsg = masker.mask(errmsg)
+
 	link := fmt.Sprintf("%s/#/repo/%s/build/%d/", config.BaseURL, repo.Name, build.ID)
 	subject := fmt.Sprintf("ding: failure: repo %s branch %s failing", repo.Name, build.Branch)
 	textMsg := fmt.Sprintf(`Hi!
@@ -16,7 +16,7 @@ import (
 )
 
 const (
-	databaseVersion = 10
+	databaseVersion = 31
 )
 
 var (
@@ -27,6 +27,7 @@ var (
 		PrintSherpaErrorStack bool
 		Database              string
 		Environment           map[string]string
+		SecretEnvironment     []string // keys in Environment with secret values, masked in build output
 		Notify                struct {
 			Name  string
 			Email string
@@ -35,12 +36,21 @@ var (
 		GithubWebhookSecret    string   // for github webhook "push" events, to create a build; configure the same secret as in your github repository settings.
 		BitbucketWebhookSecret string   // we use this in the URL the user must configure at bitbucket; they don't have any other authentication mechanism.
 		Run                    []string // prefixed to commands we run. e.g. call "nice" or "timeout"
+		MaxBuilds              int      // maximum number of builds running at the same time, across all repositories. 0 means no limit. builds on agents don't count.
 		IsolateBuilds          struct {
 			Enabled  bool // if false, we run all build commands as the user running ding.  if true, we run each build under its own uid.
 			UIDStart int  // we'll use this + buildId as the unix uid to run the commands under
 			UIDEnd   int  // if we reach this uid, we wrap around to uidStart again
 			DingUID  int  // the unix uid ding runs as, used to chown files back before deleting.
 			DingGID  int  // the unix gid ding runs as, used to run build commands under.
+			Sandbox  bool // linux only. if true, build.sh runs in new pid/mount/ipc/uts namespaces, with a read-only file system except for the build dir, and a private /tmp. can be overridden per repository.
+			Limits   struct {
+				AddressSpace int64 // bytes of virtual memory per process
+				Processes    int64 // processes for the build uid
+				FileSize     int64 // bytes, largest file that can be written
+				OpenFiles    int64 // open files per process
+				CPUSeconds   int64 // seconds of cpu time per process
+			} // resource limits for build.sh, 0 means no limit. can be overridden per repository.
 		}
 		Mail struct {
 			Enabled,
@@ -54,6 +64,19 @@ var (
 			ReplyTo,
 			ReplyToName string
 		}
+		AgentTokens       map[string]string // agent name to the token it authenticates with, for remote build agents started with "ding agent".
+		ReleaseSigningKey string            // base64-encoded ed25519 seed, as generated by "ding genkey". if set, released files get a minisign signature.
+		AdminToken        string            // token for admin-only HTTP requests, like removing the files of a yanked release. if empty, these requests are refused.
+		ReleaseS3         struct {
+			Endpoint  string // if set, released files are stored in this S3-compatible object store instead of data/release/. eg https://s3.eu-central-1.amazonaws.com, or http://localhost:9000 for minio.
+			Region    string // default us-east-1, which is also what minio uses by default
+			Bucket    string
+			Prefix    string // prepended to object names, eg "ding/"
+			AccessKey string
+			SecretKey string
+			PathStyle bool // bucket name in the URL path instead of the host name, needed for minio
+			Redirect  bool // redirect downloads of released files to presigned URLs instead of passing them through ding. archives are always made by ding.
+		}
 	}
 	database *sql.DB
 )
@@ -88,6 +111,8 @@ func main() {
 		fmt.Fprintln(os.Stderr, "       ding serve config.json")
 		fmt.Fprintln(os.Stderr, "       ding upgrade config.json [commit]")
 		fmt.Fprintln(os.Stderr, "       ding kick")
+		fmt.Fprintln(os.Stderr, "       ding agent [flags] baseurl")
+		fmt.Fprintln(os.Stderr, "       ding genkey")
 		fmt.Fprintln(os.Stderr, "       ding version")
 		flag.PrintDefaults()
 	}
@@ -108,10 +133,17 @@ func main() {
 	case "serve-http":
 		// undocumented, for unpriviliged http process
 		servehttp(args)
+	case "build-exec":
+		// undocumented, started by root process to run build.sh with resource limits and/or in a sandbox
+		buildExec(args)
 	case "upgrade":
 		upgrade(args)
 	case "kick":
 		kick(args)
+	case "agent":
+		agent(args)
+	case "genkey":
+		genkey(args)
 	case "version":
 		_version(args)
 	default:
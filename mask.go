@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+)
+
+// secrets shorter than this are not masked, they would garble the output
+const minSecretLength = 4
+
+const secretMask = "***"
+
+// masker replaces secret values in build output.
+type masker struct {
+	secrets []string  // longest first
+	first   [256]bool // whether a secret starts with the byte
+	maxLen  int       // length of the longest secret
+}
+
+// newMasker returns a masker for the secret values.
+// Each line of a multi-line value is masked separately, since output is processed in lines.
+func newMasker(values []string) *masker {
+	secrets := []string{}
+	for _, v := range values {
+		for _, s := range strings.Split(v, "\n") {
+			s = strings.TrimSpace(s)
+			if len(s) >= minSecretLength {
+				secrets = append(secrets, s)
+			}
+		}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	// longest first, so a secret containing another secret is masked entirely
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	m := &masker{secrets: secrets, maxLen: len(secrets[0])}
+	for _, s := range secrets {
+		m.first[s[0]] = true
+	}
+	return m
+}
+
+// matches returns the start and end offsets of the secrets in s, scanning from the left, preferring the longest secret at an offset.
+func (m *masker) matches(s string) (l [][2]int) {
+	for i := 0; i < len(s); i++ {
+		if !m.first[s[i]] {
+			continue
+		}
+		for _, secret := range m.secrets {
+			if strings.HasPrefix(s[i:], secret) {
+				l = append(l, [2]int{i, i + len(secret)})
+				i += len(secret) - 1
+				break
+			}
+		}
+	}
+	return
+}
+
+func (m *masker) mask(s string) string {
+	if m == nil {
+		return s
+	}
+	var b strings.Builder
+	o := 0
+	for _, match := range m.matches(s) {
+		b.WriteString(s[o:match[0]])
+		b.WriteString(secretMask)
+		o = match[1]
+	}
+	b.WriteString(s[o:])
+	return b.String()
+}
+
+// number of bytes to hold back when output is flushed halfway a line, so a secret split over the boundary is still masked
+func (m *masker) keep() int {
+	if m == nil {
+		return 0
+	}
+	return m.maxLen - 1
+}
+
+// flushPoint returns how many bytes of s, output that is flushed halfway a line, can be masked and written now.
+// The remainder is held back: the last bytes that could be the start of a secret, and a secret that would be split.
+// Masking the returned part on its own gives the same result as masking it as part of s.
+func (m *masker) flushPoint(s string) int {
+	end := len(s) - m.keep()
+	if m == nil {
+		return end
+	}
+	// matches don't overlap, at most one can span end
+	for _, match := range m.matches(s) {
+		if match[0] < end && match[1] > end {
+			return match[0]
+		}
+	}
+	return end
+}
+
+// _repoSecrets returns the secret values for builds of the repository: from the config file and from the repository environment.
+func _repoSecrets(tx *sql.Tx, repo Repo) (secrets []string) {
+	for _, key := range config.SecretEnvironment {
+		if v, ok := config.Environment[key]; ok {
+			secrets = append(secrets, v)
+		}
+	}
+	for _, v := range _repoEnv(tx, repo.ID) {
+		if v.Secret {
+			secrets = append(secrets, v.Value)
+		}
+	}
+	return
+}
+
+// _repoMasker returns the masker for output of builds of the repository.
+func _repoMasker(repo Repo) (m *masker) {
+	transact(func(tx *sql.Tx) {
+		m = newMasker(_repoSecrets(tx, repo))
+	})
+	return
+}
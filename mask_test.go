@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestMask(t *testing.T) {
+	m := newMasker([]string{"secret", "secretsecret", "abc", "  multi line\nsecond line  \n"})
+	tests := []struct {
+		s   string
+		exp string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"a secret here", "a *** here"},
+		// longest secret first, too short secrets are not masked
+		{"secretsecretsecret abc", "****** abc"},
+		{"multi line and second line", "*** and ***"},
+	}
+	for _, tc := range tests {
+		if r := m.mask(tc.s); r != tc.exp {
+			t.Errorf("mask(%q): got %q, expected %q", tc.s, r, tc.exp)
+		}
+	}
+
+	if newMasker([]string{"abc", ""}) != nil {
+		t.Errorf("masker without secrets to mask, expected nil")
+	}
+	var nilMasker *masker
+	if r := nilMasker.mask("text"); r != "text" {
+		t.Errorf("nil masker: got %q, expected text", r)
+	}
+}
+
+// readAllOutput returns the output emitted by readOutput, reading one byte at a time so the buffer fills up exactly.
+func readAllOutput(t *testing.T, m *masker, s string) string {
+	t.Helper()
+	var b strings.Builder
+	err := readOutput(iotest.OneByteReader(strings.NewReader(s)), m, func(text string) {
+		if text == "" {
+			t.Fatalf("empty text emitted")
+		}
+		b.WriteString(text)
+	})
+	if err != nil {
+		t.Fatalf("readOutput: %s", err)
+	}
+	return b.String()
+}
+
+func TestReadOutput(t *testing.T) {
+	const secret = "s3cr3tvalue"
+	m := newMasker([]string{secret, "multi-line secret\nsecond-line secret"})
+
+	// a line longer than the buffer, with a secret at each offset around the point where the buffer is flushed
+	for offset := 1024 - 2*len(secret); offset < 1024+len(secret); offset++ {
+		s := strings.Repeat("x", offset) + secret + strings.Repeat("y", 1500)
+		exp := strings.Repeat("x", offset) + secretMask + strings.Repeat("y", 1500)
+		if r := readAllOutput(t, m, s); r != exp {
+			t.Fatalf("secret at offset %d: got %q, expected %q", offset, r, exp)
+		}
+	}
+
+	// multi-line secret, each line is masked, also in lines that don't fit in the buffer
+	s := "multi-line secret\n" + strings.Repeat("z", 1020) + "second-line secret\n"
+	exp := "***\n" + strings.Repeat("z", 1020) + "***\n"
+	if r := readAllOutput(t, m, s); r != exp {
+		t.Fatalf("multi-line secret: got %q, expected %q", r, exp)
+	}
+
+	// secret longer than half of the default buffer, at each offset around the flush point of the larger buffer
+	long := strings.Repeat("0123456789", 70)
+	m = newMasker([]string{long})
+	bufSize := 2 * len(long)
+	for offset := bufSize - 2*len(long); offset < bufSize+10; offset += 7 {
+		s := strings.Repeat("x", offset) + long + strings.Repeat("y", 2000) + "\n" + long
+		exp := strings.Repeat("x", offset) + secretMask + strings.Repeat("y", 2000) + "\n" + secretMask
+		if r := readAllOutput(t, m, s); r != exp {
+			t.Fatalf("long secret at offset %d: output not masked as expected", offset)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"bitbucket.org/mjl/sherpa"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func matrixVariant(repo Repo, name string) (Variant, bool) {
+	for _, v := range repo.Matrix {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+func _checkMatrix(matrix []Variant) {
+	seen := map[string]struct{}{}
+	for _, v := range matrix {
+		if !stepNameRegexp.MatchString(v.Name) {
+			userError(fmt.Sprintf("Invalid variant name %q, must be lower case letters, digits, dashes and underscores.", v.Name))
+		}
+		if _, ok := seen[v.Name]; ok {
+			userError(fmt.Sprintf("Duplicate variant name %q.", v.Name))
+		}
+		seen[v.Name] = struct{}{}
+		for k := range v.Env {
+			_checkEnvKey(k)
+		}
+	}
+}
+
+// for storing in the database, a nil slice would become json null
+func matrixOrEmpty(matrix []Variant) []Variant {
+	if matrix == nil {
+		return []Variant{}
+	}
+	return matrix
+}
+
+// _childBuilds returns the builds for the variants of a build matrix.
+func _childBuilds(q queryRower, repoName string, parentID int) (builds []Build) {
+	qc := `select coalesce(json_agg(bwr.* order by bwr.variant), '[]') from build_with_result bwr where parent_id=$1`
+	sherpaCheckRow(q.QueryRow(qc, parentID), &builds, "fetching child builds")
+	for i, b := range builds {
+		fillBuild(repoName, &b)
+		builds[i] = b
+	}
+	return
+}
+
+// fillChildren sets the builds of variants for builds that started a build matrix.
+func fillChildren(q queryRower, repoName string, builds []Build) {
+	for i, b := range builds {
+		if b.ParentID == nil {
+			builds[i].Children = _childBuilds(q, repoName, b.ID)
+		}
+	}
+}
+
+// childReleased returns whether a variant of a build matrix was released, in which case its parent must be kept.
+func childReleased(buildID int) bool {
+	var released bool
+	q := `select exists (select 1 from build where parent_id=$1 and released is not null)`
+	sherpaCheckRow(database.QueryRow(q, buildID), &released, "checking for released child builds")
+	return released
+}
+
+// doMatrixBuild starts a build for each variant of the build matrix of repo, waits for them to finish, and sets the result of the parent build.
+// The parent build succeeds only if all variants succeed, otherwise its status becomes "failed".
+func doMatrixBuild(repo Repo, build Build, buildDir string) {
+	registerBuild(build.ID)
+	defer unregisterBuild(build.ID)
+
+	finish := func(status, errmsg string) {
+		transact(func(tx *sql.Tx) {
+			q := `update build set status=$1, error_message=$2, finish=NOW(), disk_usage=$3 where id=$4`
+			_, err := tx.Exec(q, status, errmsg, buildDiskUsage(buildDir), build.ID)
+			sherpaCheck(err, "marking build as finished in database")
+			events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
+		})
+		build.Status = status
+	}
+
+	// all variants must build the same commit, also when the branch changes while they are building
+	if build.CommitHash == "" && (repo.VCS == "git" || repo.VCS == "mercurial") {
+		commit, err := remoteHead(repo, build.Branch)
+		if err != nil {
+			finish("failed", fmt.Sprintf("Finding commit of branch %s: %s", build.Branch, err))
+			_cleanupBuilds(repo.Name, build.Branch)
+			return
+		}
+		build.CommitHash = commit
+	}
+
+	var children []Build
+	var childDirs []string
+	transact(func(tx *sql.Tx) {
+		if build.CommitHash != "" {
+			_, err := tx.Exec(`update build set commit_hash=$1 where id=$2`, build.CommitHash, build.ID)
+			sherpaCheck(err, "updating commit hash in database")
+		}
+		for _, v := range repo.Matrix {
+			child, childDir := _insertBuild(tx, repo, build.Branch, build.CommitHash, &build.ID, v.Name)
+			// variants run the scripts of the parent, which can be from an earlier build when retried
+			copyScripts(buildDir, childDir)
+			children = append(children, child)
+			childDirs = append(childDirs, childDir)
+		}
+		_, err := tx.Exec(`update build set status='matrix' where id=$1`, build.ID)
+		sherpaCheck(err, "updating build status in database")
+		events <- EventBuild{repo.Name, _build(tx, repo.Name, build.ID)}
+	})
+
+	var wg sync.WaitGroup
+	for i, child := range children {
+		events <- EventBuild{repo.Name, child}
+		j := enqueueJob(repo, child)
+		wg.Add(1)
+		go func(j job, child Build, childDir string) {
+			defer wg.Done()
+			defer func() {
+				if err := recover(); err != nil {
+					if serr, ok := err.(*sherpa.Error); ok {
+						if serr.Code != "userError" {
+							log.Println("background build failed:", serr.Message)
+						}
+					}
+				}
+			}()
+			runJob(j, repo, child, childDir)
+		}(j, child, childDirs[i])
+		if buildCancelled(build.ID) {
+			cancelBuild(repo.Name, child.ID)
+		}
+	}
+	wg.Wait()
+
+	failed := []string{}
+	cancelled := false
+	for _, child := range _childBuilds(database, repo.Name, build.ID) {
+		switch child.Status {
+		case "success":
+		case "cancelled":
+			cancelled = true
+		default:
+			failed = append(failed, child.Variant)
+		}
+	}
+	if len(failed) > 0 {
+		finish("failed", fmt.Sprintf("Variants failed: %s.", strings.Join(failed, ", ")))
+	} else if cancelled {
+		finish("cancelled", cancelledMsg)
+	} else {
+		finish("success", "")
+	}
+
+	_cleanupBuilds(repo.Name, build.Branch)
+
+	if build.Status == "success" {
+		triggerBuilds(repo, build)
+	}
+}
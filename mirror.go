@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// a mirror is updated by one build at a time, while it isn't used for cloning by other builds
+var mirrorLocks = struct {
+	sync.Mutex
+	m map[string]*sync.RWMutex
+}{m: map[string]*sync.RWMutex{}}
+
+func mirrorLock(repoName string) *sync.RWMutex {
+	mirrorLocks.Lock()
+	defer mirrorLocks.Unlock()
+	l, ok := mirrorLocks.m[repoName]
+	if !ok {
+		l = &sync.RWMutex{}
+		mirrorLocks.m[repoName] = l
+	}
+	return l
+}
+
+// mirrorDir returns the path of the local bare mirror of the origin of a repository.
+func mirrorDir(repoName string) string {
+	return fmt.Sprintf("%s/data/mirror/%s", dingWorkDir, repoName)
+}
+
+// updateMirror creates or updates the local mirror of the origin of the repository, with run executing commands as part of the clone step.
+// It returns whether the mirror can be used for cloning. If updating fails, the build clones from the origin directly.
+// The mirror is only removed if it is damaged, or if creating it failed.
+func updateMirror(repo Repo, run func(workDir string, args ...string) error) bool {
+	l := mirrorLock(repo.Name)
+	l.Lock()
+	defer l.Unlock()
+
+	dir := mirrorDir(repo.Name)
+	_, err := os.Stat(dir)
+	exists := err == nil
+	if !exists {
+		err = os.MkdirAll(dingWorkDir+"/data/mirror", 0777)
+		if err != nil {
+			log.Printf("creating mirror directory for repo %s: %s\n", repo.Name, err)
+			return false
+		}
+	}
+	switch repo.VCS {
+	case "git":
+		if exists {
+			err = run(dir, "git", "remote", "set-url", "origin", repo.Origin)
+			if err == nil {
+				err = run(dir, "git", "fetch", "--prune", "origin")
+			}
+		} else {
+			err = run(dingWorkDir, "git", "clone", "--mirror", repo.Origin, dir)
+		}
+	case "mercurial":
+		if exists {
+			err = run(dir, "hg", "pull", repo.Origin)
+		} else {
+			err = run(dingWorkDir, "hg", "clone", "--noupdate", repo.Origin, dir)
+		}
+	default:
+		return false
+	}
+	if err == nil {
+		return true
+	}
+	if !exists {
+		// a clone that failed halfway is of no use
+		log.Printf("creating mirror for repo %s, removing it: %s\n", repo.Name, err)
+		os.RemoveAll(dir)
+		return false
+	}
+	// most likely the origin is temporarily unreachable. we only remove the mirror when it is damaged.
+	log.Printf("updating mirror for repo %s, cloning from origin instead: %s\n", repo.Name, err)
+	if repo.VCS == "git" {
+		err = run(dir, "git", "fsck", "--no-progress")
+	} else {
+		err = run(dir, "hg", "verify")
+	}
+	if err != nil {
+		log.Printf("verifying mirror for repo %s, removing it: %s\n", repo.Name, err)
+		os.RemoveAll(dir)
+	}
+	return false
+}
+
+// removeMirror removes the local mirror of a repository, waiting for builds that use it.
+func removeMirror(repoName string) {
+	l := mirrorLock(repoName)
+	l.Lock()
+	defer l.Unlock()
+	err := os.RemoveAll(mirrorDir(repoName))
+	sherpaCheck(err, "removing mirror")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var stepNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// names used for build statuses that are not build steps
+var reservedStepNames = []string{"new", "clone", "checkout", "matrix", "failed", "success", "cancelled"}
+
+// repoSteps returns the steps to run for a build of the repository.
+// Without explicitly configured steps, the build script is the single step `build`.
+func repoSteps(repo Repo) []BuildStep {
+	if len(repo.Steps) > 0 {
+		return repo.Steps
+	}
+	return []BuildStep{{"build", repo.BuildScript}}
+}
+
+func validStepName(name string) bool {
+	if !stepNameRegexp.MatchString(name) {
+		return false
+	}
+	for _, s := range reservedStepNames {
+		if s == name {
+			return false
+		}
+	}
+	return true
+}
+
+func _checkSteps(steps []BuildStep) {
+	seen := map[string]struct{}{}
+	for _, step := range steps {
+		if !validStepName(step.Name) {
+			userError(fmt.Sprintf("Invalid step name %q, must be lower case letters, digits, dashes and underscores, and cannot be one of: %s.", step.Name, strings.Join(reservedStepNames, ", ")))
+		}
+		if _, ok := seen[step.Name]; ok {
+			userError(fmt.Sprintf("Duplicate step name %q.", step.Name))
+		}
+		seen[step.Name] = struct{}{}
+	}
+}
+
+// writeSteps stores the scripts for the steps of a build, along with their order.
+func writeSteps(buildDir string, steps []BuildStep) {
+	names := []string{}
+	for _, step := range steps {
+		path := fmt.Sprintf("%s/scripts/%s.sh", buildDir, step.Name)
+		writeFile(path, step.Script)
+		err := os.Chmod(path, os.FileMode(0755))
+		sherpaCheck(err, "chmod")
+		names = append(names, step.Name)
+	}
+	writeFile(buildDir+"/scripts/steps", strings.Join(names, "\n")+"\n")
+}
+
+// buildStepNames returns the names of the steps of a build, in order.
+// Builds from before steps could be configured only have step `build`.
+func buildStepNames(buildDir string) []string {
+	s := readFileLax(buildDir + "/scripts/steps")
+	if s == "" {
+		return []string{"build"}
+	}
+	return strings.Split(strings.TrimSpace(s), "\n")
+}
+
+// for storing in the database, a nil slice would become json null
+func stepsOrEmpty(steps []BuildStep) []BuildStep {
+	if steps == nil {
+		return []BuildStep{}
+	}
+	return steps
+}
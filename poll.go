@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/mjl/sherpa"
+)
+
+const (
+	minPollInterval   = 60               // seconds, polling more often is not allowed
+	maxPollBackoff    = 6 * time.Hour    // longest wait after repeated failures to reach an origin
+	pollCheckInterval = 10 * time.Second // how often we look for repositories that are due for polling
+	pollTimeout       = 2 * time.Minute  // for a single command listing branch heads
+)
+
+// polling state of repositories, by name
+var pollStates = struct {
+	sync.Mutex
+	m map[string]*pollState
+}{m: map[string]*pollState{}}
+
+// pollState is the in-memory polling state of a repository.
+type pollState struct {
+	next     time.Time // next time the origin should be polled
+	failures int       // consecutive failures to reach the origin
+	busy     bool      // whether a poll is in progress
+}
+
+func pollPatternsOrEmpty(patterns []string) []string {
+	if patterns == nil {
+		return []string{}
+	}
+	return patterns
+}
+
+func _checkPoll(repo Repo) {
+	if repo.PollInterval < 0 {
+		userError("Poll interval cannot be negative.")
+	}
+	if repo.PollInterval > 0 && repo.PollInterval < minPollInterval {
+		userError(fmt.Sprintf("Poll interval must be at least %d seconds.", minPollInterval))
+	}
+	if repo.PollInterval > 0 && repo.VCS != "git" && repo.VCS != "mercurial" {
+		userError("Polling is only possible for git and mercurial repositories.")
+	}
+	for _, p := range append(append([]string{}, repo.PollInclude...), repo.PollExclude...) {
+		if p == "" {
+			userError("Branch pattern cannot be empty.")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			userError(fmt.Sprintf("Invalid branch pattern %q: %s.", p, err))
+		}
+	}
+}
+
+// pollBranch returns whether builds for the branch should be started by polling.
+func pollBranch(repo Repo, branch string) bool {
+	include := len(repo.PollInclude) == 0
+	for _, p := range repo.PollInclude {
+		if ok, _ := path.Match(p, branch); ok {
+			include = true
+			break
+		}
+	}
+	if !include {
+		return false
+	}
+	for _, p := range repo.PollExclude {
+		if ok, _ := path.Match(p, branch); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// pollOrigins periodically checks the origins of repositories with a poll interval for branch heads that have not been built yet.
+func pollOrigins() {
+	for {
+		time.Sleep(pollCheckInterval)
+		startPolls(time.Now())
+	}
+}
+
+func startPolls(now time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			if serr, ok := err.(*sherpa.Error); ok {
+				log.Println("polling origins:", serr.Message)
+				return
+			}
+			panic(err)
+		}
+	}()
+
+	var repos []Repo
+	sherpaCheckRow(database.QueryRow(`select coalesce(json_agg(repo.*), '[]') from repo where poll_interval > 0`), &repos, "fetching repositories to poll")
+
+	pollStates.Lock()
+	defer pollStates.Unlock()
+
+	seen := map[string]bool{}
+	for _, repo := range repos {
+		seen[repo.Name] = true
+		st, ok := pollStates.m[repo.Name]
+		if !ok {
+			st = &pollState{next: now}
+			pollStates.m[repo.Name] = st
+		}
+		if st.busy || now.Before(st.next) {
+			continue
+		}
+		st.busy = true
+		go pollRepo(repo, st)
+	}
+	// forget repositories that were removed, renamed or no longer polled
+	for name, st := range pollStates.m {
+		if !seen[name] && !st.busy {
+			delete(pollStates.m, name)
+		}
+	}
+}
+
+func pollRepo(repo Repo, st *pollState) {
+	err := pollRepoHeads(repo)
+
+	pollStates.Lock()
+	defer pollStates.Unlock()
+	st.busy = false
+	interval := time.Duration(repo.PollInterval) * time.Second
+	if err == nil {
+		st.failures = 0
+		st.next = time.Now().Add(interval)
+		return
+	}
+	st.failures++
+	wait := interval
+	for i := 0; i < st.failures && wait < maxPollBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxPollBackoff {
+		wait = maxPollBackoff
+	}
+	if wait < interval {
+		wait = interval
+	}
+	st.next = time.Now().Add(wait)
+	log.Printf("polling origin of repo %s failed %d times, next attempt in %s: %s\n", repo.Name, st.failures, wait, err)
+}
+
+// pollRepoHeads lists the branch heads of the origin, and starts builds for those that differ from the last build of the branch.
+// Branches that have never been built are only built when their head changes after the first poll since polling was enabled,
+// or when they appear later, so enabling polling does not start a build for every existing branch.
+// The heads at the first poll are stored with the repository, so branches pushed while ding was not running are built after a restart.
+// An error is returned only if the origin could not be reached.
+func pollRepoHeads(repo Repo) error {
+	defer func() {
+		if err := recover(); err != nil {
+			if serr, ok := err.(*sherpa.Error); ok {
+				log.Printf("polling origin of repo %s: %s\n", repo.Name, serr.Message)
+				return
+			}
+			panic(err)
+		}
+	}()
+
+	heads, err := remoteHeads(repo)
+	if err != nil {
+		return err
+	}
+
+	var branches []string
+	for branch := range heads {
+		if pollBranch(repo, branch) {
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+
+	var baselineJSON sql.NullString
+	err = database.QueryRow(`select poll_baseline from repo where id=$1`, repo.ID).Scan(&baselineJSON)
+	sherpaCheck(err, "fetching poll baseline")
+	first := !baselineJSON.Valid
+	baseline := map[string]string{}
+	if !first {
+		err = json.Unmarshal([]byte(baselineJSON.String), &baseline)
+		sherpaCheck(err, "parsing poll baseline")
+	}
+	for _, branch := range branches {
+		commit := heads[branch]
+		var last string
+		// builds that failed before knowing their commit are skipped, unless they are still running
+		q := `select commit_hash from build where repo_id=$1 and branch=$2 and parent_id is null and (commit_hash<>'' or finish is null) order by id desc limit 1`
+		err := database.QueryRow(q, repo.ID, branch).Scan(&last)
+		if err == sql.ErrNoRows {
+			if first {
+				baseline[branch] = commit
+				continue
+			} else if baseline[branch] == commit {
+				continue
+			}
+		} else if err != nil {
+			sherpaCheck(err, "fetching last build of branch")
+		} else if last == "" || strings.HasPrefix(commit, last) || strings.HasPrefix(last, commit) {
+			// already built, or the last build is still cloning and does not know its commit yet
+			continue
+		}
+
+		log.Printf("polling found new commit %s for repo %s branch %s, starting build\n", commit, repo.Name, branch)
+		nrepo, build, buildDir, err := prepareBuild(repo.Name, branch, commit)
+		if err != nil {
+			log.Printf("polling: error starting build for repo %s, branch %s, commit %s: %s\n", repo.Name, branch, commit, err)
+			continue
+		}
+		goBuild(nrepo, build, buildDir)
+	}
+	if first {
+		_, err := database.Exec(`update repo set poll_baseline=$1::jsonb where id=$2`, toJSON(baseline), repo.ID)
+		sherpaCheck(err, "storing poll baseline")
+	}
+	return nil
+}
+
+// remoteHeads returns the commit of each branch head of the origin of a git or mercurial repository.
+func remoteHeads(repo Repo) (map[string]string, error) {
+	heads := map[string]string{}
+	switch repo.VCS {
+	case "git":
+		out, err := vcsCommand("git", "ls-remote", "--heads", repo.Origin)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			t := strings.Fields(line)
+			if len(t) != 2 || !strings.HasPrefix(t[1], "refs/heads/") {
+				continue
+			}
+			heads[strings.TrimPrefix(t[1], "refs/heads/")] = t[0]
+		}
+	case "mercurial":
+		// mercurial cannot list branches of a remote repository without pulling it.
+		// we check the branches we have built before, and the include patterns that are plain branch names.
+		branches := map[string]bool{"default": true}
+		for _, p := range repo.PollInclude {
+			if !strings.ContainsAny(p, `*?[\`) {
+				branches[p] = true
+			}
+		}
+		var built []string
+		q := `select coalesce(json_agg(distinct branch), '[]') from build where repo_id=$1 and parent_id is null`
+		sherpaCheckRow(database.QueryRow(q, repo.ID), &built, "fetching branches of builds")
+		for _, b := range built {
+			branches[b] = true
+		}
+		var firstErr error
+		for branch := range branches {
+			out, err := vcsCommand("hg", "identify", "--id", "--rev", branch, repo.Origin)
+			if err != nil {
+				// branch may have been closed or removed, but the origin may also be unreachable
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			heads[branch] = strings.TrimSpace(out)
+		}
+		if len(heads) == 0 && firstErr != nil {
+			return nil, firstErr
+		}
+	default:
+		return nil, fmt.Errorf("cannot poll repository with vcs %q", repo.VCS)
+	}
+	return heads, nil
+}
+
+// remoteHead returns the commit hash of the head of branch in the origin of the repository.
+func remoteHead(repo Repo, branch string) (string, error) {
+	var out string
+	var err error
+	switch repo.VCS {
+	case "git":
+		out, err = vcsCommand("git", "ls-remote", "--heads", repo.Origin, "refs/heads/"+branch)
+		if err == nil {
+			for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+				t := strings.Fields(line)
+				if len(t) == 2 && t[1] == "refs/heads/"+branch {
+					return t[0], nil
+				}
+			}
+		}
+	case "mercurial":
+		out, err = vcsCommand("hg", "identify", "--id", "--rev", branch, repo.Origin)
+		if err == nil && strings.TrimSpace(out) != "" {
+			return strings.TrimSpace(out), nil
+		}
+	default:
+		return "", fmt.Errorf("cannot find head for vcs %q", repo.VCS)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("branch %q not found in origin", branch)
+}
+
+// vcsCommand runs a command as the ding user, with a timeout, returning its stdout. Used for polling origins and generating changelogs.
+func vcsCommand(args ...string) (string, error) {
+	if len(config.Run) > 0 {
+		args = append(append([]string{}, config.Run...), args...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pollTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// never wait for credentials on a terminal
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "HGPLAIN=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	buf, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// QueueJob is a build that is waiting in the queue for its turn, or running.
+type QueueJob struct {
+	RepoName    string     `json:"repo_name"`
+	BuildID     int        `json:"build_id"`
+	Branch      string     `json:"branch"`
+	Variant     string     `json:"variant"`
+	Running     bool       `json:"running"`
+	Position    int        `json:"position"` // for queued builds, starting at 1, the order in which builds would start if none had to wait for a running build. 0 for running builds.
+	Queued      time.Time  `json:"queued"`
+	Started     *time.Time `json:"started"`      // null while queued
+	WaitSeconds int64      `json:"wait_seconds"` // time spent in the queue, so far for queued builds
+	Waiting     string     `json:"waiting"`      // reason a queued build has not started yet
+}
+
+// Queue returns the running builds, followed by the queued builds in order of their position.
+func (Ding) Queue() []QueueJob {
+	rc := make(chan []QueueJob)
+	queueJobs <- rc
+	return <-rc
+}
+
+func _checkQueuedBuild(repoName string, buildID int) {
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		build := _build(tx, repo.Name, buildID)
+		if build.RepoID != repo.ID {
+			userError("Build does not belong to repository.")
+		}
+	})
+}
+
+// MoveQueuedBuild moves a queued build to the front of the queue, so it is the next build to start once it is runnable.
+func (Ding) MoveQueuedBuild(repoName string, buildID int) {
+	_checkQueuedBuild(repoName, buildID)
+	m := moveJob{buildID, make(chan bool)}
+	moveJobs <- m
+	if !<-m.rc {
+		userError("Build is not queued.")
+	}
+}
+
+// DropQueuedBuild removes a queued build from the queue. The build ends with status `cancelled`.
+// Unlike CancelBuild, running builds are left alone.
+func (Ding) DropQueuedBuild(repoName string, buildID int) {
+	_checkQueuedBuild(repoName, buildID)
+	c := cancelJob{buildID, make(chan bool)}
+	cancelJobs <- c
+	if !<-c.rc {
+		userError("Build is not queued.")
+	}
+}
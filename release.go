@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const defaultReleaseChannel = "stable"
+
+var releaseChannelRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// releaseChannel returns the channel to release to, defaulting to stable, and checks it is valid.
+func releaseChannel(channel string) string {
+	if channel == "" {
+		return defaultReleaseChannel
+	}
+	if !releaseChannelRegexp.MatchString(channel) {
+		userError(fmt.Sprintf("Invalid release channel %q, must be lower case letters, digits, dots, dashes and underscores.", channel))
+	}
+	return channel
+}
+
+// SetReleaseChannel moves a release to another channel, eg `stable`, `beta` or `nightly`.
+func (Ding) SetReleaseChannel(repoName string, buildID int, channel string) (build Build) {
+	channel = releaseChannel(channel)
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		build = _build(tx, repo.Name, buildID)
+		if build.RepoID != repo.ID {
+			userError("Build does not belong to repository.")
+		}
+		if build.Released == nil {
+			userError("Build has not been released.")
+		}
+
+		q := `update build set release_channel=$1 where id=$2 returning id`
+		err := tx.QueryRow(q, channel, build.ID).Scan(&build.ID)
+		sherpaCheck(err, "updating release channel in database")
+
+		build = _build(tx, repo.Name, build.ID)
+		events <- EventBuild{repo.Name, build}
+	})
+	return
+}
+
+// semver is a parsed semantic version, see https://semver.org/.
+type semver struct {
+	major, minor, patch int64
+	pre                 []string // prerelease identifiers, empty for a release
+}
+
+// parseSemver parses versions like "1.2.3", "v1.2.3-rc.1" and "1.2", ignoring build metadata.
+func parseSemver(s string) (v semver, ok bool) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, id := range v.pre {
+			if id == "" {
+				return v, false
+			}
+		}
+	}
+	t := strings.Split(s, ".")
+	if len(t) > 3 {
+		return v, false
+	}
+	nums := []*int64{&v.major, &v.minor, &v.patch}
+	for i, e := range t {
+		n, err := strconv.ParseInt(e, 10, 64)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// compareSemver returns -1, 0 or 1 if a is older than, equal to, or newer than b.
+// Versions that cannot be parsed are older than all versions that can, and equal to each other.
+func compareSemver(a, b string) int {
+	va, aok := parseSemver(a)
+	vb, bok := parseSemver(b)
+	if !aok || !bok {
+		return cmpBool(aok, bok)
+	}
+	if c := cmpInt(va.major, vb.major); c != 0 {
+		return c
+	}
+	if c := cmpInt(va.minor, vb.minor); c != 0 {
+		return c
+	}
+	if c := cmpInt(va.patch, vb.patch); c != 0 {
+		return c
+	}
+	// a prerelease is older than the release itself
+	if len(va.pre) == 0 || len(vb.pre) == 0 {
+		return cmpBool(len(va.pre) == 0, len(vb.pre) == 0)
+	}
+	for i := 0; i < len(va.pre) && i < len(vb.pre); i++ {
+		x, y := va.pre[i], vb.pre[i]
+		nx, errx := strconv.ParseInt(x, 10, 64)
+		ny, erry := strconv.ParseInt(y, 10, 64)
+		var c int
+		switch {
+		case errx == nil && erry == nil:
+			c = cmpInt(nx, ny)
+		case errx == nil || erry == nil:
+			// numeric identifiers are older than alphanumeric ones
+			c = cmpBool(errx != nil, erry != nil)
+		default:
+			c = strings.Compare(x, y)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmpInt(int64(len(va.pre)), int64(len(vb.pre)))
+}
+
+func cmpInt(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func cmpBool(a, b bool) int {
+	if a == b {
+		return 0
+	} else if a {
+		return 1
+	}
+	return -1
+}
+
+// latestRelease returns the id of the release in the channel with the highest version, comparing the versions of the results as semver. Yanked releases are skipped.
+// If filename is not empty, only releases with a result with that name are considered, by the version of that result, so each variant of a build matrix can be found.
+// Releases with the same version are ordered by build id. Returns 0 if there is no matching release.
+func latestRelease(repoName, channel, filename string) (int, error) {
+	q := `
+		select build.id, coalesce(result.version, ''), coalesce(result.filename, '')
+		from build
+		join repo on build.repo_id = repo.id
+		left join result on build.id = result.build_id
+		where repo.name=$1 and build.released is not null and build.yanked is null and build.release_channel=$2
+	`
+	rows, err := database.Query(q, repoName, channel)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	type release struct {
+		version string
+		match   bool
+	}
+	releases := map[int]*release{}
+	for rows.Next() {
+		var id int
+		var version, name string
+		if err := rows.Scan(&id, &version, &name); err != nil {
+			return 0, err
+		}
+		rel, ok := releases[id]
+		if !ok {
+			rel = &release{"", filename == ""}
+			releases[id] = rel
+		}
+		// when looking for a file, only its own version counts, variants of a build matrix can have different versions
+		if filename != "" && (name == "" || path.Base(name) != filename) {
+			continue
+		}
+		if !rel.match || compareSemver(version, rel.version) > 0 {
+			rel.version = version
+		}
+		rel.match = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var bestID int
+	var best *release
+	for id, rel := range releases {
+		if !rel.match {
+			continue
+		}
+		if best != nil {
+			c := compareSemver(rel.version, best.version)
+			if c < 0 || c == 0 && id < bestID {
+				continue
+			}
+		}
+		bestID = id
+		best = rel
+	}
+	return bestID, nil
+}
+
+// redirectLatestRelease redirects a request for the latest release of a channel to the release itself.
+// Elems are the path elements after "latest": an optional channel, followed by the name of a file.
+// Kind is the path before the build id, eg "release/<repo>" or "download/release/<repo>".
+func redirectLatestRelease(w http.ResponseWriter, r *http.Request, kind, repoName string, elems []string, isFile bool) {
+	channel := defaultReleaseChannel
+	if len(elems) == 2 {
+		channel = elems[0]
+	} else if len(elems) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+	name := elems[len(elems)-1]
+
+	filename := ""
+	if isFile {
+		filename = strings.TrimSuffix(name, ".minisig")
+	}
+	id, err := latestRelease(repoName, channel, filename)
+	if err != nil {
+		log.Printf("release: finding latest release: %s\n", err)
+		http.Error(w, "server error", 500)
+		return
+	}
+	if id == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.Redirect(w, r, fmt.Sprintf("/%s/%d/%s", kind, id, name), http.StatusFound)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		s  string
+		v  semver
+		ok bool
+	}{
+		{"1.2.3", semver{1, 2, 3, nil}, true},
+		{"v1.2.3", semver{1, 2, 3, nil}, true},
+		{"1.2", semver{1, 2, 0, nil}, true},
+		{"1", semver{1, 0, 0, nil}, true},
+		{"1.2.3-rc.1", semver{1, 2, 3, []string{"rc", "1"}}, true},
+		{"1.2.3-beta+build.5", semver{1, 2, 3, []string{"beta"}}, true},
+		{"1.2.3+build.5", semver{1, 2, 3, nil}, true},
+		{"1.2.3.4", semver{}, false},
+		{"1.x", semver{}, false},
+		{"1.2.3-", semver{}, false},
+		{"1.2.3-rc..1", semver{}, false},
+		{"", semver{}, false},
+		{"-1.2.3", semver{}, false},
+	}
+	for _, tc := range tests {
+		v, ok := parseSemver(tc.s)
+		if ok != tc.ok || ok && !reflect.DeepEqual(v, tc.v) {
+			t.Errorf("parseSemver(%q): got %v, %v, expected %v, %v", tc.s, v, ok, tc.v, tc.ok)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	// in increasing order, from the semver specification, plus our own additions
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"v1.0.1",
+		"1.2",
+		"1.2.1",
+		"1.10.0",
+		"2.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			exp := 0
+			if i < j {
+				exp = -1
+			} else if i > j {
+				exp = 1
+			}
+			if c := compareSemver(ordered[i], ordered[j]); c != exp {
+				t.Errorf("compareSemver(%q, %q): got %d, expected %d", ordered[i], ordered[j], c, exp)
+			}
+		}
+	}
+
+	tests := []struct {
+		a, b string
+		exp  int
+	}{
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2.3+build.1", "1.2.3+build.2", 0},
+		{"1.0.0-2", "1.0.0-10", -1},     // numeric identifiers compare numerically
+		{"1.0.0-10", "1.0.0-a", -1},     // numeric identifiers are older than alphanumeric
+		{"1.0.0-rc10", "1.0.0-rc9", -1}, // alphanumeric identifiers compare lexically
+		{"junk", "0.0.1", -1},           // unparsable versions are older than any version
+		{"junk", "other", 0},
+		{"", "0.0.0-alpha", -1},
+	}
+	for _, tc := range tests {
+		if c := compareSemver(tc.a, tc.b); c != tc.exp {
+			t.Errorf("compareSemver(%q, %q): got %d, expected %d", tc.a, tc.b, c, tc.exp)
+		}
+		if c := compareSemver(tc.b, tc.a); c != -tc.exp {
+			t.Errorf("compareSemver(%q, %q): got %d, expected %d", tc.b, tc.a, c, -tc.exp)
+		}
+	}
+}
@@ -5,6 +5,13 @@ import (
 )
 
 func _removeBuild(tx *sql.Tx, repoName string, buildID int) {
+	var childIDs []int
+	qchild := `select coalesce(json_agg(id), '[]') from build where parent_id=$1`
+	sherpaCheckRow(tx.QueryRow(qchild, buildID), &childIDs, "fetching child builds")
+	for _, id := range childIDs {
+		_removeBuild(tx, repoName, id)
+	}
+
 	var filenames []string
 	qres := `select coalesce(json_agg(filename), '[]') from result where build_id=$1`
 	sherpaCheckRow(tx.QueryRow(qres, buildID), &filenames, "fetching released files")
@@ -22,7 +29,7 @@ func _removeBuild(tx *sql.Tx, repoName string, buildID int) {
 }
 
 func _removeDir(repoName string, buildID int) {
-	req := request{msg{msgRemovedir, repoName, buildID, "", nil}, make(chan error, 0), nil}
+	req := request{msg{Kind: msgRemovedir, RepoName: repoName, BuildID: buildID}, make(chan error, 0), nil}
 	rootRequests <- req
 	err := <-req.errorResponse
 	sherpaCheck(err, "removing files")
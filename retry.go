@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// copyScripts replaces the scripts of a build with those of another build.
+func copyScripts(srcBuildDir, dstBuildDir string) {
+	dst := dstBuildDir + "/scripts"
+	err := os.RemoveAll(dst)
+	sherpaCheck(err, "removing scripts")
+	err = os.MkdirAll(dst, 0777)
+	sherpaCheck(err, "creating scripts dir")
+
+	files, err := ioutil.ReadDir(srcBuildDir + "/scripts")
+	sherpaCheck(err, "listing scripts")
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(srcBuildDir + "/scripts/" + fi.Name())
+		sherpaCheck(err, "reading script")
+		err = ioutil.WriteFile(dst+"/"+fi.Name(), buf, fi.Mode().Perm())
+		sherpaCheck(err, "writing script")
+	}
+}
+
+// RetryBuild starts a new build for the branch and commit of an existing build, returning immediately.
+// If sameScripts is set, the new build runs the scripts of the original build instead of the current scripts of the repository.
+// The new build records which build it retried. Builds that failed before their commit was known cannot be retried.
+func (Ding) RetryBuild(repoName string, buildID int, sameScripts bool) (build Build) {
+	var repo Repo
+	var buildDir string
+	transact(func(tx *sql.Tx) {
+		repo = _repo(tx, repoName)
+		orig := _build(tx, repo.Name, buildID)
+		if orig.RepoID != repo.ID {
+			userError("Build does not belong to repository.")
+		}
+		if orig.ParentID != nil {
+			userError("Build is a variant of a build matrix, retry the build that started it.")
+		}
+		if orig.CommitHash == "" {
+			// we would build the current head of the branch, which may be different code
+			userError("Commit of build is not known, it failed before checkout. Start a new build of the branch instead.")
+		}
+		origDir := fmt.Sprintf("%s/data/build/%s/%d", dingWorkDir, repo.Name, orig.ID)
+		if sameScripts && orig.BuilddirRemoved {
+			userError("Build directory of build has been removed, its scripts are gone.")
+		}
+
+		build, buildDir = _insertBuild(tx, repo, orig.Branch, orig.CommitHash, nil, "")
+		_, err := tx.Exec(`update build set retry_of=$1 where id=$2`, orig.ID, build.ID)
+		sherpaCheck(err, "marking build as retry in database")
+		if sameScripts {
+			copyScripts(origDir, buildDir)
+		}
+		build = _build(tx, repo.Name, build.ID)
+	})
+	events <- EventBuild{repo.Name, build}
+
+	goBuild(repo, build, buildDir)
+	return
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rlimitAddressSpace = unix.RLIMIT_AS
+	rlimitProcesses    = unix.RLIMIT_NPROC
+)
+
+func setrlimit(resource int, soft, hard int64) error {
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: soft, Max: hard})
+}
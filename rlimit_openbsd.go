@@ -0,0 +1,15 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// openbsd has no limit on address space, only on the data segment
+	rlimitAddressSpace = unix.RLIMIT_DATA
+	rlimitProcesses    = 7 // RLIMIT_NPROC, missing from golang.org/x/sys/unix
+)
+
+func setrlimit(resource int, soft, hard int64) error {
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: uint64(soft), Max: uint64(hard)})
+}
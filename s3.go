@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how long presigned URLs for redirected downloads are valid
+const s3RedirectExpires = time.Hour
+
+// s3Storage keeps released files in a bucket of an S3-compatible object store, like AWS S3 or MinIO.
+// Requests are signed with AWS signature version 4.
+type s3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string // prepended to keys for object names
+	accessKey string
+	secretKey string
+	pathStyle bool
+	redirect  bool
+	client    *http.Client
+}
+
+func newS3Storage() (*s3Storage, error) {
+	c := config.ReleaseS3
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an http or https URL")
+	}
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("bucket must be set")
+	}
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	s := &s3Storage{
+		endpoint:  &url.URL{Scheme: u.Scheme, Host: u.Host},
+		region:    region,
+		bucket:    c.Bucket,
+		prefix:    c.Prefix,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		pathStyle: c.PathStyle,
+		redirect:  c.Redirect,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	return s, nil
+}
+
+// s3Encode encodes s as required for signing: all bytes except unreserved characters are percent-encoded, and slashes too unless keepSlash is set.
+func s3Encode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical query string for the parameters.
+func s3Query(params map[string]string) string {
+	l := []string{}
+	for k, v := range params {
+		l = append(l, s3Encode(k, false)+"="+s3Encode(v, false))
+	}
+	sort.Strings(l)
+	return strings.Join(l, "&")
+}
+
+// url returns the URL for an object, or for the bucket if object is empty.
+func (s *s3Storage) url(object string, params map[string]string) *url.URL {
+	u := *s.endpoint
+	p := ""
+	if object != "" {
+		p = "/" + object
+	}
+	if s.pathStyle {
+		p = "/" + s.bucket + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		if p == "" {
+			p = "/"
+		}
+	}
+	u.Path = p
+	u.RawPath = s3Encode(p, true)
+	u.RawQuery = s3Query(params)
+	return &u
+}
+
+// s3CanonicalRequest returns the canonical request for signing, and the list of signed headers.
+// Headers must have lower case names, and include "host".
+func s3CanonicalRequest(method string, u *url.URL, headers map[string]string, payloadHash string) (string, string) {
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&b, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+	rawPath := u.RawPath
+	if rawPath == "" {
+		rawPath = u.EscapedPath()
+	}
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s", method, rawPath, u.RawQuery, b.String(), signedHeaders, payloadHash), signedHeaders
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature returns the signature for the canonical request made at time now.
+func (s *s3Storage) signature(canonicalRequest string, now time.Time) string {
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", now.Format("20060102T150405Z"), scope, hex.EncodeToString(sum[:]))
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func (s *s3Storage) credential(now time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/s3/aws4_request", s.accessKey, now.Format("20060102"), s.region)
+}
+
+// do signs and executes a request. The payload is not signed, so it can be streamed.
+func (s *s3Storage) do(method string, u *url.URL, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	const payload = "UNSIGNED-PAYLOAD"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := map[string]string{"host": u.Host, "x-amz-content-sha256": payload, "x-amz-date": amzDate}
+	canonicalRequest, signedHeaders := s3CanonicalRequest(method, u, headers, payload)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s, SignedHeaders=%s, Signature=%s", s.credential(now), signedHeaders, s.signature(canonicalRequest, now)))
+	return s.client.Do(req)
+}
+
+// s3Error returns an error for an unexpected response, including the start of the error document.
+func s3Error(op string, resp *http.Response) error {
+	buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s: %s: %s", op, resp.Status, strings.TrimSpace(string(buf)))
+}
+
+func (s *s3Storage) Store(key string, r io.Reader, size int64) error {
+	// without a non-nil reader, an empty body would not get a content-length
+	if size == 0 {
+		r = http.NoBody
+	}
+	resp, err := s.do("PUT", s.url(s.prefix+key, nil), r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put "+key, resp)
+	}
+	return nil
+}
+
+// s3ForbiddenError is returned by Open for status 403. AWS S3 responds with 403 instead of 404 for a missing object
+// if the credentials lack permission to list the bucket.
+type s3ForbiddenError struct {
+	key string
+}
+
+func (e s3ForbiddenError) Error() string {
+	return fmt.Sprintf("s3 get %s: access denied, or object does not exist", e.key)
+}
+
+func (s *s3Storage) Open(key string) (io.ReadCloser, bool, error) {
+	resp, err := s.do("GET", s.url(s.prefix+key, nil), nil, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, false, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, false, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	case http.StatusForbidden:
+		resp.Body.Close()
+		return nil, false, s3ForbiddenError{key}
+	}
+	defer resp.Body.Close()
+	return nil, false, s3Error("get "+key, resp)
+}
+
+// URL returns a presigned URL for the object if downloads are redirected.
+func (s *s3Storage) URL(key string) (string, error) {
+	if !s.redirect {
+		return "", nil
+	}
+	now := time.Now().UTC()
+	params := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.credential(now),
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       fmt.Sprintf("%d", int(s3RedirectExpires/time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	u := s.url(s.prefix+key, params)
+	canonicalRequest, _ := s3CanonicalRequest("GET", u, map[string]string{"host": u.Host}, "UNSIGNED-PAYLOAD")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(canonicalRequest, now)
+	return u.String(), nil
+}
+
+func (s *s3Storage) Remove(key string) error {
+	return s.remove(s.prefix + key)
+}
+
+// remove deletes an object. Deleting an object that does not exist is not an error.
+func (s *s3Storage) remove(object string) error {
+	resp, err := s.do("DELETE", s.url(object, nil), nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("delete "+object, resp)
+	}
+	return nil
+}
+
+func (s *s3Storage) RemoveAll(dir string) error {
+	prefix := s.prefix + strings.TrimSuffix(dir, "/") + "/"
+	token := ""
+	for {
+		params := map[string]string{"list-type": "2", "prefix": prefix}
+		if token != "" {
+			params["continuation-token"] = token
+		}
+		resp, err := s.do("GET", s.url("", params), nil, 0)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error("list "+prefix, resp)
+			resp.Body.Close()
+			return err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list %s: parsing response: %s", prefix, err)
+		}
+		for _, c := range result.Contents {
+			if err := s.remove(c.Key); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
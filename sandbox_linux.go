@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const sandboxSupported = true
+
+// sandboxSysProcAttr makes the process start in new pid, mount, ipc and uts namespaces.
+func sandboxSysProcAttr(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+}
+
+// networkSysProcAttr makes the process start in a new network namespace, without network interfaces except loopback.
+func networkSysProcAttr(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= unix.CLONE_NEWNET
+}
+
+// setupLoopback brings up the loopback interface in a new network namespace, it starts out down.
+func setupLoopback() {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	check(err, "creating socket for configuring loopback")
+	defer unix.Close(fd)
+
+	// struct ifreq, with the interface name followed by a union of which we only use the flags
+	var ifr struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [24 - 2]byte
+	}
+	copy(ifr.name[:], "lo")
+	ioctl := func(req uintptr) syscall.Errno {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&ifr)))
+		return errno
+	}
+	if errno := ioctl(unix.SIOCGIFFLAGS); errno != 0 {
+		check(errno, "getting loopback interface flags")
+	}
+	ifr.flags |= unix.IFF_UP | unix.IFF_RUNNING
+	if errno := ioctl(unix.SIOCSIFFLAGS); errno != 0 {
+		check(errno, "bringing up loopback interface")
+	}
+}
+
+// setupSandbox is called in the new namespaces, still as root.
+// It makes all mounts read-only, except for dir. It mounts a private /tmp and /dev/shm, and a /proc for the new pid namespace.
+func setupSandbox(dir string) {
+	wd, err := os.Getwd()
+	check(err, "getting work dir")
+
+	// don't let our changes propagate to the mounts of the host
+	check(unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""), "making mounts private")
+
+	// mount points, with their per-mount flags, as read from mountinfo
+	type mount struct {
+		path  string
+		flags uintptr
+	}
+	var mounts []mount
+	f, err := os.Open("/proc/self/mountinfo")
+	check(err, "opening mountinfo")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		t := strings.Split(scanner.Text(), " ")
+		if len(t) < 6 {
+			continue
+		}
+		m := mount{path: unescapeMountPath(t[4])}
+		for _, opt := range strings.Split(t[5], ",") {
+			switch opt {
+			case "nosuid":
+				m.flags |= unix.MS_NOSUID
+			case "nodev":
+				m.flags |= unix.MS_NODEV
+			case "noexec":
+				m.flags |= unix.MS_NOEXEC
+			case "noatime":
+				m.flags |= unix.MS_NOATIME
+			case "nodiratime":
+				m.flags |= unix.MS_NODIRATIME
+			case "relatime":
+				m.flags |= unix.MS_RELATIME
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	check(scanner.Err(), "reading mountinfo")
+	check(f.Close(), "closing mountinfo")
+
+	for _, m := range mounts {
+		err := unix.Mount("", m.path, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|m.flags, "")
+		if err != nil && err != unix.ENOENT && err != unix.EACCES {
+			check(err, "remounting "+m.path+" read-only")
+		}
+	}
+
+	// the builddir is a new mount, writable again
+	check(unix.Mount(dir, dir, "", unix.MS_BIND|unix.MS_REC, ""), "bind mounting build dir")
+	check(unix.Mount("", dir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_NOSUID|unix.MS_NODEV, ""), "remounting build dir writable")
+
+	check(unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"), "mounting private /tmp")
+	if _, err := os.Stat("/dev/shm"); err == nil {
+		check(unix.Mount("tmpfs", "/dev/shm", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"), "mounting private /dev/shm")
+	}
+	check(unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""), "mounting /proc")
+
+	check(unix.Sethostname([]byte("ding")), "setting hostname")
+
+	// our work dir is still on the read-only mount
+	check(os.Chdir(wd), "changing to work dir")
+}
+
+// mount points in mountinfo have spaces, tabs, newlines and backslashes escaped as octal
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var r []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				r = append(r, byte(v))
+				i += 3
+				continue
+			}
+		}
+		r = append(r, s[i])
+	}
+	return string(r)
+}
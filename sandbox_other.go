@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+	"syscall"
+)
+
+const sandboxSupported = false
+
+func sandboxSysProcAttr(attr *syscall.SysProcAttr) {
+}
+
+func setupSandbox(dir string) {
+	log.Fatalln("sandbox only supported on linux")
+}
+
+func networkSysProcAttr(attr *syscall.SysProcAttr) {
+}
+
+func setupLoopback() {
+	log.Fatalln("network isolation only supported on linux")
+}
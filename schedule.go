@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"bitbucket.org/mjl/sherpa"
+)
+
+// Schedule starts builds of a branch at times given by a cron expression.
+type Schedule struct {
+	ID     int    `json:"id"`
+	RepoID int    `json:"repo_id"`
+	Branch string `json:"branch"`
+	Cron   string `json:"cron"` // 5 fields: minute, hour, day of month, month, day of week. in the time zone of the ding server.
+}
+
+// RepoSchedules returns the schedules for builds of a repository.
+func (Ding) RepoSchedules(repoName string) (schedules []Schedule) {
+	q := `select coalesce(json_agg(s.* order by s.id), '[]') from schedule s join repo on s.repo_id = repo.id where repo.name=$1`
+	sherpaCheckRow(database.QueryRow(q, repoName), &schedules, "fetching schedules")
+	return
+}
+
+// CreateSchedule adds a schedule for builds of a branch of a repository.
+func (Ding) CreateSchedule(repoName, branch, cron string) (schedule Schedule) {
+	if branch == "" {
+		userError("Branch cannot be empty.")
+	}
+	if _, err := parseCron(cron); err != nil {
+		userError(fmt.Sprintf("Invalid cron expression: %s.", err))
+	}
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		q := `insert into schedule (repo_id, branch, cron) values ($1, $2, $3) returning row_to_json(schedule.*)`
+		sherpaCheckRow(tx.QueryRow(q, repo.ID, branch, cron), &schedule, "inserting schedule into database")
+	})
+	return
+}
+
+// RemoveSchedule removes a schedule of a repository.
+func (Ding) RemoveSchedule(repoName string, scheduleID int) {
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		var id int
+		sherpaCheckRow(tx.QueryRow(`delete from schedule where id=$1 and repo_id=$2 returning id`, scheduleID, repo.ID), &id, "removing schedule from database")
+	})
+}
+
+// scheduleBuilds starts builds for schedules, checking at the start of each minute.
+func scheduleBuilds() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		startScheduled(next)
+	}
+}
+
+func startScheduled(tm time.Time) {
+	defer func() {
+		if err := recover(); err != nil {
+			if serr, ok := err.(*sherpa.Error); ok {
+				log.Println("starting scheduled builds:", serr.Message)
+				return
+			}
+			panic(err)
+		}
+	}()
+
+	var schedules []struct {
+		RepoName string `json:"repo_name"`
+		Branch   string `json:"branch"`
+		Cron     string `json:"cron"`
+	}
+	q := `select coalesce(json_agg(x.*), '[]') from (select repo.name as repo_name, s.branch, s.cron from schedule s join repo on s.repo_id = repo.id) x`
+	sherpaCheckRow(database.QueryRow(q), &schedules, "fetching schedules")
+	for _, s := range schedules {
+		cs, err := parseCron(s.Cron)
+		if err != nil {
+			log.Printf("bad cron expression %q for repo %s: %s\n", s.Cron, s.RepoName, err)
+			continue
+		}
+		if cs.matches(tm) {
+			// a failing schedule should not keep the others from starting
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						if serr, ok := err.(*sherpa.Error); ok {
+							log.Printf("starting scheduled build for repo %s, branch %s: %s\n", s.RepoName, s.Branch, serr.Message)
+							return
+						}
+						panic(err)
+					}
+				}()
+				startScheduledBuild(s.RepoName, s.Branch)
+			}()
+		}
+	}
+}
+
+func startScheduledBuild(repoName, branch string) {
+	var repo Repo
+	var build Build
+	var buildDir string
+	transact(func(tx *sql.Tx) {
+		repo = _repo(tx, repoName)
+		build, buildDir = _insertBuild(tx, repo, branch, "", nil, "")
+		_, err := tx.Exec(`update build set scheduled=true where id=$1`, build.ID)
+		sherpaCheck(err, "marking build as scheduled in database")
+		build = _build(tx, repo.Name, build.ID)
+	})
+	events <- EventBuild{repo.Name, build}
+
+	goBuild(repo, build, buildDir)
+}
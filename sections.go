@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// a line "step:<name>" on stdout starts a new section within a build step
+var sectionMarkerRegexp = regexp.MustCompile(`^step:([a-zA-Z0-9_.\-]{1,64})$`)
+
+// sectionMarkers returns the names of sections started in text, which consists of whole lines.
+func sectionMarkers(text string) (names []string) {
+	for _, line := range strings.Split(text, "\n") {
+		m := sectionMarkerRegexp.FindStringSubmatch(strings.TrimSpace(line))
+		if m != nil {
+			names = append(names, m[1])
+		}
+	}
+	return
+}
+
+// sectionLineReader gathers stdout text that may arrive in pieces into whole lines, for finding section markers.
+type sectionLineReader struct {
+	partial string // text after the last newline, held until the rest of its line arrives
+	skip    bool   // whether we are in a line that is too long to be a section marker
+}
+
+// add returns the names of sections started in the lines completed by text.
+func (r *sectionLineReader) add(text string) []string {
+	if r.skip {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			return nil
+		}
+		text = text[i+1:]
+		r.skip = false
+	}
+	text = r.partial + text
+	i := strings.LastIndexByte(text, '\n')
+	r.partial = text[i+1:]
+	// a marker line is short, no need to keep more
+	if len(r.partial) > 1024 {
+		r.partial = ""
+		r.skip = true
+	}
+	if i < 0 {
+		return nil
+	}
+	return sectionMarkers(text[:i])
+}
+
+// flush returns the names of sections started in a last line without newline.
+func (r *sectionLineReader) flush() []string {
+	text := r.partial
+	r.partial = ""
+	r.skip = false
+	if text == "" {
+		return nil
+	}
+	return sectionMarkers(text)
+}
+
+// parseSections reads the contents of a .sections file, with lines "<nsec since start of step> <name>".
+// The duration of a section lasts until the start of the next section, or the end of the step, stepNsec, if known.
+func parseSections(s string, stepNsec int64) []Section {
+	sections := []Section{}
+	for _, line := range strings.Split(s, "\n") {
+		t := strings.SplitN(line, " ", 2)
+		if len(t) != 2 {
+			continue
+		}
+		start, err := strconv.ParseInt(t[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		sections = append(sections, Section{Name: t[1], Start: start})
+	}
+	for i := range sections {
+		if i+1 < len(sections) {
+			sections[i].Nsec = sections[i+1].Start - sections[i].Start
+		} else if stepNsec > 0 {
+			sections[i].Nsec = stepNsec - sections[i].Start
+		}
+	}
+	return sections
+}
+
+// sectionError adds the section that was running to the error of a failed step.
+func sectionError(err error, section string) error {
+	if err == nil || section == "" {
+		return err
+	}
+	return fmt.Errorf("%s (in section %s)", err, section)
+}
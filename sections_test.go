@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSectionLineReader(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		exp    []string
+	}{
+		{[]string{"step:a\n", "x\nstep:b\n"}, []string{"a", "b"}},
+		// marker split over chunks
+		{[]string{"st", "ep:", "a\n"}, []string{"a"}},
+		{[]string{"x\nstep:", "a\nstep:b"}, []string{"a", "b"}},
+		// marker text inside a longer line is not a marker
+		{[]string{"output step:a", "\n"}, nil},
+		{[]string{"output ", "step:a\n"}, nil},
+		// marker after a line that was too long to keep
+		{[]string{strings.Repeat("x", 2000), "step:a", "\nstep:b\n"}, []string{"b"}},
+	}
+	for _, tc := range tests {
+		var r sectionLineReader
+		var names []string
+		for _, c := range tc.chunks {
+			names = append(names, r.add(c)...)
+		}
+		names = append(names, r.flush()...)
+		if !reflect.DeepEqual(names, tc.exp) {
+			t.Errorf("chunks %q: got sections %q, expected %q", tc.chunks, names, tc.exp)
+		}
+	}
+}
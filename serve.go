@@ -2,13 +2,17 @@ package main
 
 import (
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -20,6 +24,12 @@ var (
 	listenWebhookAddress = serveFlag.String("listenwebhook", ":6085", "address to listen on for webhooks, like from github; set empty for no listening")
 
 	rootRequests chan request // for http-serve
+
+	// running build.sh processes, by build id, for cancelling builds
+	rootBuilds = struct {
+		sync.Mutex
+		m map[int]*os.Process
+	}{m: map[int]*os.Process{}}
 )
 
 func serve(args []string) {
@@ -48,6 +58,9 @@ func serve(args []string) {
 	} else if !config.IsolateBuilds.Enabled && os.Getuid() == 0 {
 		log.Fatalln(`mjust not run as root when isolateBuilds is disabled`)
 	}
+	if config.IsolateBuilds.Sandbox && !sandboxSupported {
+		log.Fatalln(`isolateBuilds sandbox is only supported on linux`)
+	}
 
 	proto := 0
 	// we exchange gob messages with unprivileged httpserver over socketsA
@@ -115,6 +128,10 @@ func serve(args []string) {
 			doMsgRemovedir(msg, enc)
 		case msgBuild:
 			doMsgBuild(msg, enc, unixconn)
+		case msgCancel:
+			doMsgCancel(msg, enc)
+		case msgRemoveCache, msgRestoreCache, msgSaveCache:
+			doMsgCache(msg, enc, unixconn)
 		default:
 			log.Fatalf("unknown msg kind %d\n", msg.Kind)
 		}
@@ -164,6 +181,10 @@ func doMsgChown(msg msg, enc *gob.Encoder) {
 	if err == nil {
 		err = chown(buildDir + "/checkout")
 	}
+	if err == nil && msg.Cache {
+		// the copy of the cache has files of previous builds, with other uids
+		err = chown(buildDir + "/cache")
+	}
 	err = enc.Encode(errstr(err))
 	check(err, "encoding msg")
 }
@@ -182,6 +203,89 @@ func doMsgRemovedir(msg msg, enc *gob.Encoder) {
 	check(err, "writing removedir response")
 }
 
+// doMsgCache handles the cache messages. Cache dirs can be large, so the work is done in the background, while
+// other messages are handled. The response is followed by a status fd, from which a gob-encoded string with the result is read.
+func doMsgCache(msg msg, enc *gob.Encoder, unixconn *net.UnixConn) {
+	if msg.RepoName == "" || msg.Kind != msgRemoveCache && msg.BuildID <= 0 {
+		log.Fatalf("received cache msg %d with empty RepoName or without BuildID\n", msg.Kind)
+	}
+	var fn func() error
+	switch msg.Kind {
+	case msgRemoveCache:
+		fn = func() error { return removeCache(msg.RepoName, msg.BuildID) }
+	case msgRestoreCache:
+		fn = func() error { return restoreCache(msg.RepoName, msg.BuildID) }
+	case msgSaveCache:
+		fn = func() error { return saveCache(msg.RepoName, msg.BuildID) }
+	}
+
+	err := enc.Encode("")
+	check(err, "writing cache response")
+
+	statusr, statusw, err := os.Pipe()
+	check(err, "create status pipe")
+	defer statusr.Close()
+	_, _, err = unixconn.WriteMsgUnix([]byte{1}, unix.UnixRights(int(statusr.Fd())), nil)
+	if err != nil {
+		statusw.Close()
+		check(err, "sending fd from root to http")
+	}
+
+	go func() {
+		defer statusw.Close()
+		err := fn()
+		if err != nil {
+			log.Printf("cache for repo %s, build %d: %s\n", msg.RepoName, msg.BuildID, err)
+		}
+		err = gob.NewEncoder(statusw).Encode(errstr(err))
+		check(err, "writing cache status")
+	}()
+}
+
+// removeCache removes the cache dir of a repository, or (if buildID > 0) the copy of a build.
+func removeCache(repoName string, buildID int) error {
+	path := cacheDir(repoName)
+	if buildID > 0 {
+		path = fmt.Sprintf("%s/data/build/%s/%d/cache", dingWorkDir, repoName, buildID)
+	}
+	return removeTree(path)
+}
+
+// restoreCache copies the cache dir of a repository into the build dir.
+func restoreCache(repoName string, buildID int) error {
+	src := cacheDir(repoName)
+	dst := fmt.Sprintf("%s/data/build/%s/%d/cache", dingWorkDir, repoName, buildID)
+	if err := removeTree(dst); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return os.Mkdir(dst, 0777)
+	} else if err != nil {
+		return err
+	}
+	return copyDir(src, dst)
+}
+
+// saveCache moves the copy of the cache dir of a build in place of the cache dir of the repository.
+func saveCache(repoName string, buildID int) error {
+	dir := cacheDir(repoName)
+	src := fmt.Sprintf("%s/data/build/%s/%d/cache", dingWorkDir, repoName, buildID)
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return err
+	}
+	// leftover from an earlier save that failed halfway
+	if err := removeTree(dir + ".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, dir+".old"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(src, dir); err != nil {
+		return err
+	}
+	return removeTree(dir + ".old")
+}
+
 func doMsgBuild(msg msg, enc *gob.Encoder, unixconn *net.UnixConn) {
 	outr, outw, err := os.Pipe()
 	check(err, "create stdout pipe")
@@ -202,7 +306,43 @@ func doMsgBuild(msg msg, enc *gob.Encoder, unixconn *net.UnixConn) {
 	check(err, "opening /dev/null")
 	defer devnull.Close()
 
-	argv := []string{buildDir + "/scripts/build.sh"}
+	sandbox := config.IsolateBuilds.Enabled && msg.Sandbox
+	if sandbox && !sandboxSupported {
+		enc.Encode("sandbox only supported on linux")
+		return
+	}
+	if msg.IsolateNetwork && (!config.IsolateBuilds.Enabled || !sandboxSupported) {
+		enc.Encode("network isolation requires isolated builds on linux")
+		return
+	}
+	// whether build-exec starts as root, to set up namespaces
+	privileged := sandbox || msg.IsolateNetwork
+
+	if !validStepName(msg.Step) {
+		enc.Encode("invalid step name")
+		return
+	}
+	argv := []string{fmt.Sprintf("%s/scripts/%s.sh", buildDir, msg.Step)}
+	if privileged || config.IsolateBuilds.Enabled && !msg.Limits.isZero() {
+		exe, err := os.Executable()
+		if err != nil {
+			log.Println("finding ding executable:", err)
+			enc.Encode(err.Error())
+			return
+		}
+		args := msg.Limits.args()
+		if privileged {
+			// build-exec switches to the build uid after setting up the namespaces
+			args = append(args, fmt.Sprintf("-uid=%d", uid), fmt.Sprintf("-gid=%d", config.IsolateBuilds.DingGID))
+		}
+		if sandbox {
+			args = append(args, "-sandbox="+buildDir)
+		}
+		if msg.IsolateNetwork {
+			args = append(args, "-loopback")
+		}
+		argv = append(append([]string{exe, "build-exec"}, args...), argv...)
+	}
 	attr := &os.ProcAttr{
 		Dir: checkoutDir,
 		Env: msg.Env,
@@ -212,13 +352,21 @@ func doMsgBuild(msg msg, enc *gob.Encoder, unixconn *net.UnixConn) {
 			errw,
 		},
 	}
-	if config.IsolateBuilds.Enabled {
-		attr.Sys = &syscall.SysProcAttr{
-			Credential: &syscall.Credential{
-				Uid:    uint32(uid),
-				Gid:    uint32(config.IsolateBuilds.DingGID),
-				Groups: []uint32{},
-			},
+	// in its own process group, so we can kill it with all its children when the build is cancelled
+	attr.Sys = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	if sandbox {
+		sandboxSysProcAttr(attr.Sys)
+	}
+	if msg.IsolateNetwork {
+		networkSysProcAttr(attr.Sys)
+	}
+	if !privileged && config.IsolateBuilds.Enabled {
+		attr.Sys.Credential = &syscall.Credential{
+			Uid:    uint32(uid),
+			Gid:    uint32(config.IsolateBuilds.DingGID),
+			Groups: []uint32{},
 		}
 	}
 	proc, err := os.StartProcess(argv[0], argv, attr)
@@ -227,6 +375,23 @@ func doMsgBuild(msg msg, enc *gob.Encoder, unixconn *net.UnixConn) {
 		enc.Encode(err.Error())
 		return
 	}
+	rootBuilds.Lock()
+	rootBuilds.m[msg.BuildID] = proc
+	rootBuilds.Unlock()
+
+	var timedOut int32
+	var timer *time.Timer
+	if msg.Timeout > 0 {
+		timer = time.AfterFunc(time.Duration(msg.Timeout)*time.Second, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			rootBuilds.Lock()
+			defer rootBuilds.Unlock()
+			if _, ok := rootBuilds.m[msg.BuildID]; ok {
+				unix.Kill(-proc.Pid, unix.SIGKILL)
+			}
+		})
+	}
+
 	err = enc.Encode(errstr(err))
 	check(err, "writing build start")
 
@@ -244,10 +409,38 @@ func doMsgBuild(msg msg, enc *gob.Encoder, unixconn *net.UnixConn) {
 
 	go func() {
 		state, err := proc.Wait()
-		if err == nil && !state.Success() {
-			err = fmt.Errorf(state.String())
+		if timer != nil {
+			timer.Stop()
+		}
+		rootBuilds.Lock()
+		delete(rootBuilds.m, msg.BuildID)
+		rootBuilds.Unlock()
+		if atomic.LoadInt32(&timedOut) != 0 {
+			err = fmt.Errorf("timeout of %ds for build step reached", msg.Timeout)
+		} else if err == nil && !state.Success() {
+			err = errors.New(state.String())
+			if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				if s := limitSignal(msg.Limits, ws.Signal()); s != "" {
+					err = fmt.Errorf("%s: %s", err, s)
+				}
+			}
 		}
 		err = gob.NewEncoder(statusw).Encode(errstr(err))
 		check(err, "writing status to http-serve")
 	}()
 }
+
+func doMsgCancel(msg msg, enc *gob.Encoder) {
+	var err error
+	rootBuilds.Lock()
+	proc, ok := rootBuilds.m[msg.BuildID]
+	if ok {
+		err = unix.Kill(-proc.Pid, unix.SIGKILL)
+		if err == unix.ESRCH {
+			err = nil
+		}
+	}
+	rootBuilds.Unlock()
+	err = enc.Encode(errstr(err))
+	check(err, "writing cancel response")
+}
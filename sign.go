@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// key for signing released files, nil if not configured
+var signingKey ed25519.PrivateKey
+
+// loadSigningKey parses config.ReleaseSigningKey, a base64-encoded ed25519 seed.
+func loadSigningKey() {
+	if config.ReleaseSigningKey == "" {
+		return
+	}
+	seed, err := base64.StdEncoding.DecodeString(config.ReleaseSigningKey)
+	check(err, "parsing releaseSigningKey from config")
+	if len(seed) != ed25519.SeedSize {
+		check(fmt.Errorf("got %d bytes, need %d", len(seed), ed25519.SeedSize), "parsing releaseSigningKey from config")
+	}
+	signingKey = ed25519.NewKeyFromSeed(seed)
+}
+
+// signingKeyID returns the 8 byte key id, as used in minisign files. We derive it from the public key.
+func signingKeyID(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(pub)
+	return sum[:8]
+}
+
+// minisignPublicKey returns the public key in the format of minisign.
+func minisignPublicKey(pub ed25519.PublicKey) string {
+	keyID := signingKeyID(pub)
+	buf := append(append([]byte("Ed"), keyID...), pub...)
+	return fmt.Sprintf("untrusted comment: minisign public key %016X\n%s\n", binary.LittleEndian.Uint64(keyID), base64.StdEncoding.EncodeToString(buf))
+}
+
+// minisignSignature returns a detached signature in the minisign format for the data read from r.
+// It uses the prehashed "ED" algorithm, signing the BLAKE2b-512 hash of the data, so large files don't have to be held in memory.
+func minisignSignature(key ed25519.PrivateKey, r io.Reader, filename string, tm time.Time) ([]byte, error) {
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	keyID := signingKeyID(key.Public().(ed25519.PublicKey))
+	sig := ed25519.Sign(key, h.Sum(nil))
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s", tm.Unix(), filename)
+	global := ed25519.Sign(key, append(append([]byte{}, sig...), trusted...))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "untrusted comment: signature from ding secret key\n")
+	fmt.Fprintf(&b, "%s\n", base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyID...), sig...)))
+	fmt.Fprintf(&b, "trusted comment: %s\n", trusted)
+	fmt.Fprintf(&b, "%s\n", base64.StdEncoding.EncodeToString(global))
+	return b.Bytes(), nil
+}
+
+// signRelease stores a signature for the released file src as key, if a signing key is configured.
+func signRelease(src, key string) {
+	if signingKey == nil {
+		return
+	}
+	f, err := os.Open(src)
+	sherpaCheck(err, "opening result file for signing")
+	defer f.Close()
+	sig, err := minisignSignature(signingKey, f, path.Base(src), time.Now())
+	sherpaCheck(err, "reading result file for signing")
+	err = releaseStore.Store(key, bytes.NewReader(sig), int64(len(sig)))
+	sherpaCheck(err, "storing signature file")
+}
+
+// serveSigningKey serves the public key for verifying signatures of released files.
+func serveSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "bad method", 405)
+		return
+	}
+	if signingKey == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, minisignPublicKey(signingKey.Public().(ed25519.PublicKey)))
+}
+
+// genkey generates a key for signing releases, and prints it for the config file, with its public key.
+func genkey(args []string) {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ding genkey")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	_, err := rand.Read(seed)
+	check(err, "reading random bytes")
+	key := ed25519.NewKeyFromSeed(seed)
+	fmt.Printf("# for the config file:\n\"releaseSigningKey\": \"%s\"\n\n", base64.StdEncoding.EncodeToString(seed))
+	fmt.Printf("# public key, also served at /release.pub:\n%s", minisignPublicKey(key.Public().(ed25519.PublicKey)))
+}
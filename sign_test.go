@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func decodeBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decoding base64 %q: %s", s, err)
+	}
+	return buf
+}
+
+// TestMinisign checks that signatures verify against the public key, like minisign does.
+func TestMinisign(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	pub := key.Public().(ed25519.PublicKey)
+	keyID := signingKeyID(pub)
+
+	lines := strings.Split(minisignPublicKey(pub), "\n")
+	if len(lines) != 3 || lines[2] != "" || lines[0] != fmt.Sprintf("untrusted comment: minisign public key %016X", binary.LittleEndian.Uint64(keyID)) {
+		t.Fatalf("bad public key file %q", lines)
+	}
+	pubBuf := decodeBase64(t, lines[1])
+	if len(pubBuf) != 2+8+ed25519.PublicKeySize || string(pubBuf[:2]) != "Ed" || !bytes.Equal(pubBuf[2:10], keyID) {
+		t.Fatalf("bad public key %x", pubBuf)
+	}
+	decodedPub := ed25519.PublicKey(pubBuf[10:])
+
+	data := bytes.Repeat([]byte("ding release\n"), 1000)
+	tm := time.Unix(1500000000, 0)
+	sigFile, err := minisignSignature(key, bytes.NewReader(data), "ding-1.0.tgz", tm)
+	if err != nil {
+		t.Fatalf("signing: %s", err)
+	}
+	lines = strings.Split(string(sigFile), "\n")
+	if len(lines) != 5 || lines[4] != "" || !strings.HasPrefix(lines[0], "untrusted comment: ") {
+		t.Fatalf("bad signature file %q", lines)
+	}
+	sigBuf := decodeBase64(t, lines[1])
+	if len(sigBuf) != 2+8+ed25519.SignatureSize || string(sigBuf[:2]) != "ED" || !bytes.Equal(sigBuf[2:10], keyID) {
+		t.Fatalf("bad signature %x", sigBuf)
+	}
+	sig := sigBuf[10:]
+	sum := blake2b.Sum512(data)
+	if !ed25519.Verify(decodedPub, sum[:], sig) {
+		t.Fatalf("signature does not verify")
+	}
+
+	const trustedPrefix = "trusted comment: "
+	if !strings.HasPrefix(lines[2], trustedPrefix) {
+		t.Fatalf("bad trusted comment line %q", lines[2])
+	}
+	trusted := strings.TrimPrefix(lines[2], trustedPrefix)
+	if exp := "timestamp:1500000000\tfile:ding-1.0.tgz"; trusted != exp {
+		t.Fatalf("got trusted comment %q, expected %q", trusted, exp)
+	}
+	global := decodeBase64(t, lines[3])
+	if !ed25519.Verify(decodedPub, append(append([]byte{}, sig...), trusted...), global) {
+		t.Fatalf("global signature does not verify")
+	}
+
+	// a signature must not verify for other data
+	sum = blake2b.Sum512(data[1:])
+	if ed25519.Verify(decodedPub, sum[:], sig) {
+		t.Fatalf("signature verifies for modified data")
+	}
+}
@@ -0,0 +1,5 @@
+select assert_schema_version(10);
+insert into schema_upgrades (version) values (11);
+
+alter table repo add column build_concurrency int not null default 1;
+alter table repo add constraint build_concurrency_positive check(build_concurrency >= 1);
@@ -0,0 +1,5 @@
+select assert_schema_version(11);
+insert into schema_upgrades (version) values (12);
+
+alter table build drop constraint build_status_check;
+alter table build add constraint build_status_check check(status in ('new', 'clone', 'checkout', 'build', 'test', 'release', 'success', 'cancelled'));
@@ -0,0 +1,6 @@
+select assert_schema_version(12);
+insert into schema_upgrades (version) values (13);
+
+alter table repo add column clone_timeout int not null default 0;
+alter table repo add column build_timeout int not null default 0;
+alter table repo add constraint timeouts_not_negative check(clone_timeout >= 0 and build_timeout >= 0);
@@ -0,0 +1,4 @@
+select assert_schema_version(13);
+insert into schema_upgrades (version) values (14);
+
+alter table repo add column limits jsonb not null default '{}';
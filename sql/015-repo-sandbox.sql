@@ -0,0 +1,5 @@
+select assert_schema_version(14);
+insert into schema_upgrades (version) values (15);
+
+-- null means: use setting from config file
+alter table repo add column sandbox boolean;
@@ -0,0 +1,4 @@
+select assert_schema_version(15);
+insert into schema_upgrades (version) values (16);
+
+alter table repo add column isolate_network boolean not null default false;
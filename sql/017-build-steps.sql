@@ -0,0 +1,8 @@
+select assert_schema_version(16);
+insert into schema_upgrades (version) values (17);
+
+alter table repo add column steps jsonb not null default '[]';
+
+-- status is the name of the running or failed step, which can now be configured
+alter table build drop constraint build_status_check;
+alter table build add constraint build_status_check check(status != '');
@@ -0,0 +1,18 @@
+select assert_schema_version(17);
+insert into schema_upgrades (version) values (18);
+
+alter table repo add column matrix jsonb not null default '[]';
+
+alter table build add column parent_id int references build(id);
+alter table build add column variant text not null default '';
+create index build_parent_id on build(parent_id);
+
+drop view build_with_result;
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
@@ -0,0 +1,11 @@
+select assert_schema_version(18);
+insert into schema_upgrades (version) values (19);
+
+create table repo_env (
+	id serial primary key,
+	repo_id int not null references repo(id),
+	key text not null,
+	value text not null,
+	secret boolean not null default false,
+	unique(repo_id, key)
+);
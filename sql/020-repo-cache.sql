@@ -0,0 +1,5 @@
+select assert_schema_version(19);
+insert into schema_upgrades (version) values (20);
+
+alter table repo add column cache boolean not null default false;
+alter table repo add column cache_disk_usage bigint not null default 0;
@@ -0,0 +1,14 @@
+select assert_schema_version(20);
+insert into schema_upgrades (version) values (21);
+
+alter table build add column retry_of int references build(id) on delete set null;
+
+drop view build_with_result;
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
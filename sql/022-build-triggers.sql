@@ -0,0 +1,16 @@
+select assert_schema_version(21);
+insert into schema_upgrades (version) values (22);
+
+alter table repo add column triggers jsonb not null default '[]';
+
+alter table build add column triggered_by int references build(id) on delete set null;
+
+drop view build_with_result;
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
@@ -0,0 +1,21 @@
+select assert_schema_version(22);
+insert into schema_upgrades (version) values (23);
+
+create table schedule (
+	id serial primary key,
+	repo_id int not null references repo(id),
+	branch text not null,
+	cron text not null
+);
+
+alter table build add column scheduled boolean not null default false;
+
+drop view build_with_result;
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
@@ -0,0 +1,6 @@
+select assert_schema_version(23);
+insert into schema_upgrades (version) values (24);
+
+alter table repo add column poll_interval int not null default 0;
+alter table repo add column poll_include jsonb not null default '[]';
+alter table repo add column poll_exclude jsonb not null default '[]';
@@ -0,0 +1,4 @@
+select assert_schema_version(24);
+insert into schema_upgrades (version) values (25);
+
+alter table repo add column agent_labels jsonb not null default '[]';
@@ -0,0 +1,15 @@
+select assert_schema_version(25);
+insert into schema_upgrades (version) values (26);
+
+drop view build_with_result;
+
+alter table result add column sha256 text not null default '';
+
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
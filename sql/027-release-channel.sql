@@ -0,0 +1,16 @@
+select assert_schema_version(26);
+insert into schema_upgrades (version) values (27);
+
+drop view build_with_result;
+
+alter table build add column release_channel text not null default '';
+update build set release_channel='stable' where released is not null;
+
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
@@ -0,0 +1,4 @@
+select assert_schema_version(27);
+insert into schema_upgrades (version) values (28);
+
+alter table release add column changelog json;
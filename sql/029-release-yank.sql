@@ -0,0 +1,16 @@
+select assert_schema_version(28);
+insert into schema_upgrades (version) values (29);
+
+drop view build_with_result;
+
+alter table build add column yanked timestamptz;
+alter table build add column yank_reason text not null default '';
+
+create view build_with_result as
+select
+	build.*,
+	array_remove(array_agg(result.*), null) as results
+from build
+left join result on build.id = result.build_id
+group by build.id
+;
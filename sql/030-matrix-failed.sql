@@ -0,0 +1,5 @@
+select assert_schema_version(29);
+insert into schema_upgrades (version) values (30);
+
+-- builds of a build matrix that finished with failed variants kept status "matrix"
+update build set status='failed' where status='matrix' and finish is not null;
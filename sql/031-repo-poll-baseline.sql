@@ -0,0 +1,5 @@
+select assert_schema_version(30);
+insert into schema_upgrades (version) values (31);
+
+-- heads of branches without builds at the first poll after polling was enabled, null until then
+alter table repo add column poll_baseline jsonb;
@@ -14,6 +14,8 @@ import (
 // - `build`, build was updated or created
 // - `removeBuild`, build was removed
 // - `output`, new lines of output from a command for an active build
+// - `enqueue`, build was added to the queue
+// - `dequeue`, build left the queue, because it started or was cancelled
 //
 // These types are described below, with an _event_-prefix. E.g. type _EventRepo_ describes the `repo` event.
 type SSE struct {
@@ -21,7 +23,7 @@ type SSE struct {
 
 // ExampleSSE is a no-op.
 // This function only serves to include documentation for the server-sent event types.
-func (SSE) ExampleSSE() (repo EventRepo, removeRepo EventRemoveRepo, build EventBuild, removeBuild EventRemoveBuild, output EventOutput) {
+func (SSE) ExampleSSE() (repo EventRepo, removeRepo EventRemoveRepo, build EventBuild, removeBuild EventRemoveBuild, output EventOutput, enqueue EventEnqueue, dequeue EventDequeue) {
 	return
 }
 
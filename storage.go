@@ -0,0 +1,139 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// releaseStorage stores released files. Keys are of the form "<repo>/<buildid>/<filename>".
+type releaseStorage interface {
+	// Store writes size bytes from r as the file for key, replacing an existing file.
+	Store(key string, r io.Reader, size int64) error
+	// Open returns the contents of the file for key, and whether they are gzipped.
+	// If the file does not exist, the error satisfies os.IsNotExist.
+	Open(key string) (rc io.ReadCloser, gzipped bool, err error)
+	// URL returns a URL to redirect clients to for downloading the file, or the empty string if ding should serve the file itself.
+	URL(key string) (string, error)
+	// Remove removes the file for key.
+	Remove(key string) error
+	// RemoveAll removes all files in dir, eg "<repo>" or "<repo>/<buildid>".
+	RemoveAll(dir string) error
+}
+
+// where released files are stored, set at startup
+var releaseStore releaseStorage = localStorage{"data/release"}
+
+// initReleaseStorage sets releaseStore from the config file, for storing released files in an S3-compatible object store.
+// Files released before are still read from the local directory.
+func initReleaseStorage() {
+	if config.ReleaseS3.Endpoint == "" {
+		return
+	}
+	s, err := newS3Storage()
+	check(err, "initializing s3 release storage")
+	releaseStore = fallbackStorage{s, localStorage{"data/release"}}
+}
+
+// fallbackStorage stores new files in primary, and reads files that are missing from primary from local.
+// Used to keep serving releases made before switching to object storage.
+type fallbackStorage struct {
+	primary releaseStorage
+	local   localStorage
+}
+
+func (s fallbackStorage) Store(key string, r io.Reader, size int64) error {
+	return s.primary.Store(key, r, size)
+}
+
+func (s fallbackStorage) Open(key string) (io.ReadCloser, bool, error) {
+	rc, gzipped, err := s.primary.Open(key)
+	if os.IsNotExist(err) {
+		return s.local.Open(key)
+	}
+	if _, ok := err.(s3ForbiddenError); ok {
+		// may be a missing object, see s3ForbiddenError. we keep the error if the file is not local either.
+		if lrc, lgzipped, lerr := s.local.Open(key); lerr == nil {
+			return lrc, lgzipped, nil
+		}
+	}
+	return rc, gzipped, err
+}
+
+func (s fallbackStorage) URL(key string) (string, error) {
+	// local files are served by ding
+	if _, err := os.Stat(s.local.path(key)); err == nil {
+		return "", nil
+	}
+	return s.primary.URL(key)
+}
+
+func (s fallbackStorage) Remove(key string) error {
+	err := s.primary.Remove(key)
+	if xerr := s.local.Remove(key); err == nil && !os.IsNotExist(xerr) {
+		err = xerr
+	}
+	return err
+}
+
+func (s fallbackStorage) RemoveAll(dir string) error {
+	err := s.primary.RemoveAll(dir)
+	if xerr := s.local.RemoveAll(dir); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+// localStorage keeps released files gzipped in a local directory.
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(key string) string {
+	return s.dir + "/" + key + ".gz"
+}
+
+func (s localStorage) Store(key string, r io.Reader, size int64) (rerr error) {
+	p := s.path(key)
+	err := os.MkdirAll(path.Dir(p), 0777)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			os.Remove(p)
+		}
+	}()
+	gzw := gzip.NewWriter(f)
+	_, err = io.Copy(gzw, r)
+	if err == nil {
+		err = gzw.Close()
+	}
+	if xerr := f.Close(); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+func (s localStorage) Open(key string) (io.ReadCloser, bool, error) {
+	f, err := os.Open(s.path(key))
+	return f, true, err
+}
+
+func (s localStorage) URL(key string) (string, error) {
+	return "", nil
+}
+
+func (s localStorage) Remove(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s localStorage) RemoveAll(dir string) error {
+	return os.RemoveAll(s.dir + "/" + strings.TrimSuffix(dir, "/"))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// errorStorage is a primary storage for which Open always fails.
+type errorStorage struct {
+	localStorage
+	err error
+}
+
+func (s errorStorage) Open(key string) (io.ReadCloser, bool, error) {
+	return nil, false, s.err
+}
+
+func TestFallbackStorage(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "ding-release")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+	local := localStorage{tmp}
+	if err := local.Store("repo/1/file", strings.NewReader("local"), 5); err != nil {
+		t.Fatalf("store: %s", err)
+	}
+
+	notExist := &os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}
+	for _, primaryErr := range []error{notExist, s3ForbiddenError{"repo/1/file"}} {
+		s := fallbackStorage{errorStorage{err: primaryErr}, local}
+		rc, gzipped, err := s.Open("repo/1/file")
+		if err != nil || !gzipped {
+			t.Fatalf("open with primary error %v: got gzipped %v, err %v, expected local file", primaryErr, gzipped, err)
+		}
+		rc.Close()
+
+		_, _, err = s.Open("repo/1/missing")
+		if primaryErr == notExist && !os.IsNotExist(err) {
+			t.Fatalf("open missing file: got err %v, expected not exist", err)
+		}
+		if _, ok := err.(s3ForbiddenError); primaryErr != notExist && !ok {
+			t.Fatalf("open missing file with primary access denied: got err %v, expected access denied", err)
+		}
+	}
+}
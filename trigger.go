@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"bitbucket.org/mjl/sherpa"
+)
+
+// builds triggered by a chain of builds longer than this are not started
+const maxTriggerDepth = 10
+
+func triggersOrEmpty(triggers []Trigger) []Trigger {
+	if triggers == nil {
+		return []Trigger{}
+	}
+	return triggers
+}
+
+func _checkTriggers(repo Repo) {
+	for _, t := range repo.Triggers {
+		if t.Branch == "" {
+			userError("Branch of trigger cannot be empty.")
+		}
+		for _, name := range t.Repos {
+			if name == repo.Name {
+				userError("Repository cannot trigger builds of itself.")
+			}
+		}
+	}
+}
+
+// _checkTriggerCycles verifies that, with the triggers as stored in the database, no build can trigger itself again.
+func _checkTriggerCycles(tx *sql.Tx) {
+	var repos []struct {
+		Name     string    `json:"name"`
+		Triggers []Trigger `json:"triggers"`
+	}
+	q := `select coalesce(json_agg(json_build_object('name', name, 'triggers', triggers)), '[]') from repo`
+	sherpaCheckRow(tx.QueryRow(q), &repos, "fetching triggers from database")
+
+	// (repo, branch) to the repositories it triggers builds for, on that branch
+	edges := map[repoBranch][]string{}
+	for _, r := range repos {
+		for _, t := range r.Triggers {
+			k := repoBranch{repoName: r.Name, branch: t.Branch}
+			edges[k] = append(edges[k], t.Repos...)
+		}
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[repoBranch]int{}
+	var visit func(k repoBranch, path []string)
+	visit = func(k repoBranch, path []string) {
+		path = append(path, k.repoName)
+		switch state[k] {
+		case visiting:
+			userError(fmt.Sprintf("Triggers form a cycle on branch %s: %s.", k.branch, strings.Join(path, " -> ")))
+		case done:
+			return
+		}
+		state[k] = visiting
+		for _, name := range edges[k] {
+			visit(repoBranch{repoName: name, branch: k.branch}, path)
+		}
+		state[k] = done
+	}
+	for k := range edges {
+		visit(k, nil)
+	}
+}
+
+// triggerBuilds starts builds of the downstream repositories configured for the branch of a successful build.
+// Repositories that are already in the chain of builds that triggered this build are skipped, so we never loop.
+func triggerBuilds(repo Repo, build Build) {
+	// the build itself succeeded, failing to trigger others does not change that
+	defer func() {
+		if err := recover(); err != nil {
+			if serr, ok := err.(*sherpa.Error); ok {
+				log.Printf("triggering builds for repo %s build %d: %s\n", repo.Name, build.ID, serr.Message)
+				return
+			}
+			panic(err)
+		}
+	}()
+
+	var downstream []string
+	for _, t := range repo.Triggers {
+		if t.Branch == build.Branch {
+			downstream = append(downstream, t.Repos...)
+		}
+	}
+	if len(downstream) == 0 {
+		return
+	}
+
+	var chain []string
+	q := `
+		with recursive chain(id, repo_id, triggered_by, depth) as (
+			select id, repo_id, triggered_by, 1 from build where id=$1
+			union all
+			select b.id, b.repo_id, b.triggered_by, c.depth+1 from build b join chain c on b.id = c.triggered_by where c.depth < $2
+		)
+		select coalesce(json_agg(repo.name), '[]') from chain join repo on chain.repo_id = repo.id
+	`
+	sherpaCheckRow(database.QueryRow(q, build.ID, maxTriggerDepth+1), &chain, "fetching chain of triggering builds")
+	if len(chain) > maxTriggerDepth {
+		log.Printf("not triggering builds for repo %s build %d, chain of triggered builds too long\n", repo.Name, build.ID)
+		return
+	}
+	inChain := map[string]bool{}
+	for _, name := range chain {
+		inChain[name] = true
+	}
+
+	for _, name := range downstream {
+		if inChain[name] {
+			log.Printf("not triggering build of repo %s from repo %s build %d, it would form a cycle\n", name, repo.Name, build.ID)
+			continue
+		}
+		inChain[name] = true
+		triggerBuild(name, build)
+	}
+}
+
+func triggerBuild(repoName string, upstream Build) {
+	defer func() {
+		if err := recover(); err != nil {
+			if serr, ok := err.(*sherpa.Error); ok {
+				log.Printf("triggering build of repo %s: %s\n", repoName, serr.Message)
+				return
+			}
+			panic(err)
+		}
+	}()
+
+	var exists bool
+	sherpaCheckRow(database.QueryRow(`select exists (select 1 from repo where name=$1)`, repoName), &exists, "checking for repo")
+	if !exists {
+		log.Printf("not triggering build of repo %s, it does not exist\n", repoName)
+		return
+	}
+
+	var repo Repo
+	var build Build
+	var buildDir string
+	transact(func(tx *sql.Tx) {
+		repo = _repo(tx, repoName)
+		build, buildDir = _insertBuild(tx, repo, upstream.Branch, "", nil, "")
+		_, err := tx.Exec(`update build set triggered_by=$1 where id=$2`, upstream.ID, build.ID)
+		sherpaCheck(err, "marking build as triggered in database")
+		build = _build(tx, repo.Name, build.ID)
+	})
+	events <- EventBuild{repo.Name, build}
+
+	goBuild(repo, build, buildDir)
+}
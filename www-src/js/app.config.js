@@ -17,6 +17,9 @@ app.config(function($routeProvider, $uibTooltipProvider) {
 		resolve: {
 			repoBuilds: function() {
 				return api.repoBuilds();
+			},
+			queue: function() {
+				return api.queue();
 			}
 		}
 	})
@@ -29,6 +32,12 @@ app.config(function($routeProvider, $uibTooltipProvider) {
 			},
 			builds: function($route) {
 				return api.builds($route.current.params.repoName);
+			},
+			repoEnv: function($route) {
+				return api.repoEnv($route.current.params.repoName);
+			},
+			schedules: function($route) {
+				return api.repoSchedules($route.current.params.repoName);
 			}
 		}
 	})
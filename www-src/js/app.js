@@ -57,7 +57,9 @@ var app = angular.module('app', [
 			'removeRepo',
 			'build',
 			'removeBuild',
-			'output'
+			'output',
+			'enqueue',
+			'dequeue'
 		];
 		_.forEach(kinds, function(kind) {
 			events.addEventListener(kind, function(e) {
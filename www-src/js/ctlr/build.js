@@ -16,6 +16,12 @@ app.controller('Build', function($scope, $rootScope, $q, $location, $timeout, Ms
 
 	$scope.$on('build', function(x, e) {
 		var b = e.build;
+		if (b.parent_id && b.parent_id === $scope.build.id) {
+			$timeout(function() {
+				$scope.build.children = _.map($scope.build.children, function(c) { return c.id === b.id ? b : c; });
+			});
+			return;
+		}
 		if (b.id !== $scope.build.id) {
 			return;
 		}
@@ -42,10 +48,26 @@ app.controller('Build', function($scope, $rootScope, $q, $location, $timeout, Ms
 					name: e.step,
 					output: '',
 					// nsec: 0,
+					sections: [],
 					_start: new Date().getTime()
 				};
 				$scope.steps.push(step);
 			}
+			if (e.where === 'stdout') {
+				var now = new Date().getTime();
+				_.forEach(e.text.split('\n'), function(line) {
+					var m = /^step:([a-zA-Z0-9_.\-]{1,64})$/.exec(line.trim());
+					if (!m) {
+						return;
+					}
+					var start = (now - step._start) * 1000 * 1000;
+					var prev = _.last(step.sections);
+					if (prev) {
+						prev.nsec = start - prev.start;
+					}
+					step.sections.push({name: m[1], start: start, nsec: 0});
+				});
+			}
 			step.output += e.text;
 		});
 	});
@@ -61,17 +83,24 @@ app.controller('Build', function($scope, $rootScope, $q, $location, $timeout, Ms
 		});
 	};
 
-	$scope.retryBuild = function() {
+	$scope.cancelBuild = function() {
+		var build = $scope.build;
+		return Msg.confirm('Are you sure?', function() {
+			return api.cancelBuild(repo.name, build.id);
+		});
+	};
+
+	$scope.retryBuild = function(sameScripts) {
 		var build = $scope.build;
-		return api.createBuild(repo.name, build.branch, build.commit_hash)
+		return api.retryBuild(repo.name, build.id, sameScripts)
 		.then(function(nbuild) {
 			$location.path('/repo/' + repo.name + '/build/' + nbuild.id + '/');
 		});
 	};
 
-	$scope.release = function() {
+	$scope.release = function(channel) {
 		var build = $scope.build;
-		return api.createRelease(repo.name, build.id)
+		return api.createRelease(repo.name, build.id, channel)
 		.then(function(nbuild) {
 			$location.path('/repo/' + repo.name + '/release/' + build.id + '/');
 		});
@@ -3,10 +3,33 @@
 /* global app, api, _, console */
 'use strict';
 
-app.controller('Index', function($scope, $rootScope, $q, $uibModal, $location, $timeout, Util, repoBuilds) {
+app.controller('Index', function($scope, $rootScope, $q, $uibModal, $location, $timeout, Msg, Util, repoBuilds, queue) {
 	$rootScope.breadcrumbs = Util.crumbs([]);
 
 	$scope.repoBuilds = repoBuilds;
+	$scope.queue = queue;
+
+	function reloadQueue() {
+		return api.queue()
+		.then(function(l) {
+			$scope.queue = l;
+		});
+	}
+
+	$scope.$on('enqueue', reloadQueue);
+	$scope.$on('dequeue', reloadQueue);
+
+	$scope.moveQueuedBuild = function(j) {
+		return api.moveQueuedBuild(j.repo_name, j.build_id)
+		.then(reloadQueue);
+	};
+
+	$scope.dropQueuedBuild = function(j) {
+		return Msg.confirm('Are you sure?', function() {
+			return api.dropQueuedBuild(j.repo_name, j.build_id)
+			.then(reloadQueue);
+		});
+	};
 
 	$scope.$on('repo', function(x, e) {
 		$timeout(function() {
@@ -44,6 +67,13 @@ app.controller('Index', function($scope, $rootScope, $q, $uibModal, $location, $
 				console.log('build for unknown repo?', b, repoName);
 				return;
 			}
+			if (b.parent_id) {
+				var parent = _.find(rb.builds, {id: b.parent_id});
+				if (parent) {
+					parent.children = _.sortBy(_.filter(parent.children || [], function(c) { return c.id !== b.id; }).concat([b]), 'variant');
+				}
+				return;
+			}
 			for (var i = 0; i < rb.builds.length; i++) {
 				var bb = rb.builds[i];
 				if (bb.id === b.id || bb.branch === b.branch) {
@@ -14,4 +14,26 @@ app.controller('Release', function($scope, $rootScope, $q, $location, Msg, Util,
 	$scope.buildResult = buildResult;
 	$scope.build = buildResult.build;
 	$scope.steps = buildResult.steps;
+	$scope.changelog = buildResult.changelog;
+	$scope.yank = {reason: ''};
+	$scope.yankedQuery = buildResult.build.yanked ? '?yanked=1' : '';
+	$scope.channel = buildResult.build.release_channel;
+
+	$scope.setReleaseChannel = function(channel) {
+		return api.setReleaseChannel(repo.name, $scope.build.id, channel)
+		.then(function(build) {
+			$scope.build = build;
+			$scope.channel = build.release_channel;
+		});
+	};
+
+	$scope.yankRelease = function(reason) {
+		return Msg.confirm('Are you sure?', function() {
+			return api.yankRelease(repo.name, $scope.build.id, reason)
+			.then(function(build) {
+				$scope.build = build;
+				$scope.yankedQuery = '?yanked=1';
+			});
+		});
+	};
 });
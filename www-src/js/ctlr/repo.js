@@ -3,18 +3,48 @@
 /* global app, api, _ */
 'use strict';
 
-app.controller('Repo', function($scope, $rootScope, $q, $location, $timeout, Msg, Util, repo, builds) {
+app.controller('Repo', function($scope, $rootScope, $q, $location, $timeout, Msg, Util, repo, builds, repoEnv, schedules) {
 	$rootScope.breadcrumbs = Util.crumbs([
 		Util.crumb('repo/' + repo.name, 'Repo ' + repo.name)
 	]);
 
 
+	function matrixEnvText(repo) {
+		_.forEach(repo.matrix, function(v) {
+			v._env = _.map(_.sortBy(_.keys(v.env)), function(k) { return k + '=' + v.env[k]; }).join('\n');
+		});
+	}
+
+	function releasedBuilds(builds) {
+		var l = _.flatMap(builds, function(b) { return [b].concat(b.children || []); });
+		return _.filter(l, function(b) { return b.released; });
+	}
+
+	function triggerReposText(repo) {
+		_.forEach(repo.triggers, function(t) {
+			t._repos = (t.repos || []).join(', ');
+		});
+	}
+
+	function listFieldsText(repo) {
+		repo._poll_include = (repo.poll_include || []).join(', ');
+		repo._poll_exclude = (repo.poll_exclude || []).join(', ');
+		repo._agent_labels = (repo.agent_labels || []).join(', ');
+	}
+
+	matrixEnvText(repo);
+	triggerReposText(repo);
+	listFieldsText(repo);
 	$scope.repo = repo;
 	$scope.builds = builds;
-	$scope.releaseBuilds = _.filter($scope.builds, function(b) { return b.released; });
+	$scope.repoEnv = repoEnv;
+	$scope.newEnv = {key: '', value: '', secret: false};
+	$scope.schedules = schedules;
+	$scope.newSchedule = {branch: repo.vcs === 'mercurial' ? 'default' : 'master', cron: ''};
+	$scope.releaseBuilds = releasedBuilds($scope.builds);
 
 	function updateReleaseBuilds() {
-		$scope.releaseBuilds = _.filter($scope.builds, function(b) { return b.released; });
+		$scope.releaseBuilds = releasedBuilds($scope.builds);
 	}
 	updateReleaseBuilds();
 
@@ -31,6 +61,15 @@ app.controller('Repo', function($scope, $rootScope, $q, $location, $timeout, Msg
 			return;
 		}
 		$timeout(function() {
+			if (b.parent_id) {
+				var parent = _.find($scope.builds, {id: b.parent_id});
+				if (parent) {
+					parent.children = _.filter(parent.children || [], function(c) { return c.id !== b.id; }).concat([b]);
+					parent.children = _.sortBy(parent.children, 'variant');
+					updateReleaseBuilds();
+				}
+				return;
+			}
 			for (var i = 0; i < $scope.builds.length; i++) {
 				var bb = $scope.builds[i];
 				if (bb.id === b.id) {
@@ -64,7 +103,120 @@ app.controller('Repo', function($scope, $rootScope, $q, $location, $timeout, Msg
 	};
 
 	$scope.save = function() {
-		return api.saveRepo($scope.repo);
+		var repo = _.cloneDeep($scope.repo);
+		_.forEach(repo.matrix, function(v) {
+			v.env = {};
+			_.forEach(v._env.split('\n'), function(line) {
+				line = line.trim();
+				var i = line.indexOf('=');
+				if (i > 0) {
+					v.env[line.substring(0, i)] = line.substring(i+1);
+				}
+			});
+			delete v._env;
+		});
+		_.forEach(repo.triggers, function(t) {
+			t.repos = _.filter(_.map(t._repos.split(','), _.trim));
+			delete t._repos;
+		});
+		repo.poll_include = _.filter(_.map(repo._poll_include.split(','), _.trim));
+		repo.poll_exclude = _.filter(_.map(repo._poll_exclude.split(','), _.trim));
+		delete repo._poll_include;
+		delete repo._poll_exclude;
+		repo.agent_labels = _.filter(_.map(repo._agent_labels.split(','), _.trim));
+		delete repo._agent_labels;
+		return api.saveRepo(repo)
+		.then(function(r) {
+			matrixEnvText(r);
+			triggerReposText(r);
+			listFieldsText(r);
+			$scope.repo = r;
+		});
+	};
+
+	function reloadEnv() {
+		return api.repoEnv($scope.repo.name)
+		.then(function(l) {
+			$scope.repoEnv = l;
+		});
+	}
+
+	$scope.setEnv = function(v) {
+		return api.setRepoEnv($scope.repo.name, v.key, v.value, v.secret)
+		.then(function() {
+			$scope.newEnv = {key: '', value: '', secret: false};
+			return reloadEnv();
+		});
+	};
+
+	$scope.removeEnv = function(v) {
+		return Msg.confirm('Are you sure?', function() {
+			return api.removeRepoEnv($scope.repo.name, v.key)
+			.then(reloadEnv);
+		});
+	};
+
+	$scope.createSchedule = function(s) {
+		return api.createSchedule($scope.repo.name, s.branch, s.cron)
+		.then(function(ns) {
+			$scope.schedules.push(ns);
+			$scope.newSchedule.cron = '';
+		});
+	};
+
+	$scope.removeSchedule = function(s) {
+		return Msg.confirm('Are you sure?', function() {
+			return api.removeSchedule($scope.repo.name, s.id)
+			.then(function() {
+				$scope.schedules = _.filter($scope.schedules, function(x) { return x.id !== s.id; });
+			});
+		});
+	};
+
+	$scope.clearCache = function() {
+		return Msg.confirm('Are you sure?', function() {
+			return api.clearRepoCache($scope.repo.name)
+			.then(function(r) {
+				$scope.repo.cache_disk_usage = r.cache_disk_usage;
+			});
+		});
+	};
+
+	$scope.addTrigger = function() {
+		$scope.repo.triggers = ($scope.repo.triggers || []).concat([{branch: 'master', repos: [], _repos: ''}]);
+	};
+
+	$scope.removeTrigger = function(index) {
+		$scope.repo.triggers.splice(index, 1);
+	};
+
+	$scope.addVariant = function() {
+		$scope.repo.matrix = ($scope.repo.matrix || []).concat([{name: '', env: {}, _env: ''}]);
+	};
+
+	$scope.removeVariant = function(index) {
+		$scope.repo.matrix.splice(index, 1);
+	};
+
+	$scope.addStep = function() {
+		var steps = $scope.repo.steps || [];
+		if (steps.length === 0 && $scope.repo.build_script) {
+			// build.sh becomes the first step
+			steps.push({name: 'build', script: $scope.repo.build_script});
+		}
+		steps.push({name: '', script: ''});
+		$scope.repo.steps = steps;
+	};
+
+	$scope.removeStep = function(index) {
+		$scope.repo.steps.splice(index, 1);
+	};
+
+	$scope.moveStep = function(index, delta) {
+		var steps = $scope.repo.steps;
+		var step = steps[index];
+		steps.splice(index, 1);
+		steps.splice(index+delta, 0, step);
 	};
 
 	$scope.removeBuild = function(build) {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// response header set when downloading files of a yanked release, with the reason it was yanked
+const yankedHeader = "X-Release-Yanked"
+
+// YankRelease withdraws a release, eg because it has a serious bug. Yanked releases are never the latest release of a channel.
+// Their files can only be downloaded by adding "?yanked=1" to the URL.
+func (Ding) YankRelease(repoName string, buildID int, reason string) (build Build) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		userError("Reason cannot be empty.")
+	}
+	if strings.ContainsAny(reason, "\r\n") {
+		userError("Reason must be a single line.")
+	}
+	transact(func(tx *sql.Tx) {
+		repo := _repo(tx, repoName)
+		build = _build(tx, repo.Name, buildID)
+		if build.RepoID != repo.ID {
+			userError("Build does not belong to repository.")
+		}
+		if build.Released == nil {
+			userError("Build has not been released.")
+		}
+		if build.Yanked != nil {
+			userError("Release has already been yanked.")
+		}
+
+		q := `update build set yanked=now(), yank_reason=$1 where id=$2 returning id`
+		err := tx.QueryRow(q, reason, build.ID).Scan(&build.ID)
+		sherpaCheck(err, "marking release as yanked in database")
+
+		build = _build(tx, repo.Name, build.ID)
+		events <- EventBuild{repo.Name, build}
+	})
+	return
+}
+
+// checkYanked returns whether files of the release can be downloaded, writing an error response if not.
+// Files of yanked releases are refused with status 410, unless the request has query string parameter "yanked=1".
+func checkYanked(w http.ResponseWriter, r *http.Request, repoName string, buildID int) bool {
+	q := `
+		select build.yanked is not null, build.yank_reason
+		from build
+		join repo on build.repo_id = repo.id
+		where repo.name=$1 and build.id=$2
+	`
+	var yanked bool
+	var reason string
+	err := database.QueryRow(q, repoName, buildID).Scan(&yanked, &reason)
+	if err == sql.ErrNoRows {
+		// serving the file results in a 404
+		return true
+	} else if err != nil {
+		log.Printf("release: checking if release is yanked: %s\n", err)
+		http.Error(w, "server error", 500)
+		return false
+	}
+	if !yanked {
+		return true
+	}
+	if r.URL.Query().Get("yanked") != "1" {
+		http.Error(w, fmt.Sprintf("release has been yanked: %s\nadd ?yanked=1 to the URL to download anyway", reason), http.StatusGone)
+		return false
+	}
+	w.Header().Set(yankedHeader, reason)
+	return true
+}
+
+// purgeRelease removes the files of a yanked release, for
+//
+//	DELETE /release/<reponame>/<buildid>
+//
+// with an "Authorization: Bearer <token>" header with the adminToken from the config file.
+// The release itself stays in the database.
+func purgeRelease(w http.ResponseWriter, r *http.Request, repoName, buildIDStr string) {
+	token := bearerToken(r)
+	if config.AdminToken == "" || token == "" || subtle.ConstantTimeCompare([]byte(config.AdminToken), []byte(token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	buildID, err := strconv.Atoi(buildIDStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := `
+		select build.yanked is not null
+		from build
+		join repo on build.repo_id = repo.id
+		where repo.name=$1 and build.id=$2 and build.released is not null
+	`
+	var yanked bool
+	err = database.QueryRow(q, repoName, buildID).Scan(&yanked)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("release: checking release for purge: %s\n", err)
+		http.Error(w, "server error", 500)
+		return
+	}
+	if !yanked {
+		http.Error(w, "release must be yanked before its files can be removed", http.StatusConflict)
+		return
+	}
+
+	err = releaseStore.RemoveAll(fmt.Sprintf("%s/%d", repoName, buildID))
+	if err != nil {
+		log.Printf("release: removing files of release %s/%d: %s\n", repoName, buildID, err)
+		http.Error(w, "server error", 500)
+		return
+	}
+	log.Printf("release: removed files of yanked release %s/%d\n", repoName, buildID)
+	w.WriteHeader(http.StatusNoContent)
+}